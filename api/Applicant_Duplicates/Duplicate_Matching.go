@@ -0,0 +1,168 @@
+package Applicant_Duplicates
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Applicants"
+)
+
+// MatchingPolicy weighs how alike the name, phone and address of two applicants are into a score
+// between 0 and 1. Two applicants whose score reaches Threshold are queued for review as a duplicate
+// candidate. A field counts as a reason for the match when it is at least FieldMatch alike.
+type MatchingPolicy struct {
+	NameWeight    float64
+	PhoneWeight   float64
+	AddressWeight float64
+	FieldMatch    float64
+	Threshold     float64
+}
+
+var matchingPolicy MatchingPolicy
+
+func readMatchingPolicyFromFile(filename string) (MatchingPolicy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return MatchingPolicy{}, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var policy MatchingPolicy
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&policy); err != nil {
+		return MatchingPolicy{}, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	weights := policy.NameWeight + policy.PhoneWeight + policy.AddressWeight
+	if policy.NameWeight < 0 || policy.PhoneWeight < 0 || policy.AddressWeight < 0 || weights < 0.999 || weights > 1.001 {
+		return MatchingPolicy{}, fmt.Errorf("invalid matching policy: weights must not be negative and must add up to 1")
+	}
+	if policy.Threshold <= 0 || policy.Threshold > 1 || policy.FieldMatch <= 0 || policy.FieldMatch > 1 {
+		return MatchingPolicy{}, fmt.Errorf("invalid matching policy: Threshold and FieldMatch must be between 0 and 1")
+	}
+	return policy, nil
+}
+
+// match scores how likely two applicants are the same person and names the fields that matched. The
+// same national ID is a certain match, different national IDs are never a match, whatever the rest.
+func match(a Loan_Applicants.Loan_applicants, b Loan_Applicants.Loan_applicants, nationalIDs map[int]string) (float64, []string) {
+	nationalIDA, okA := nationalIDs[a.Applicant_id]
+	nationalIDB, okB := nationalIDs[b.Applicant_id]
+	if okA && okB {
+		if nationalIDA == nationalIDB {
+			return 1, []string{"national_id"}
+		}
+		return 0, nil
+	}
+
+	// The name may have been entered with first and last name swapped
+	nameA := normalise(a.First_name + " " + a.Last_name)
+	name := similarity(nameA, normalise(b.First_name+" "+b.Last_name))
+	if swapped := similarity(nameA, normalise(b.Last_name+" "+b.First_name)); swapped > name {
+		name = swapped
+	}
+	phone := 0.0
+	if phoneA := phoneDigits(a.Phone); phoneA != "" && phoneA == phoneDigits(b.Phone) {
+		phone = 1
+	}
+	address := tokenOverlap(normalise(a.Address), normalise(b.Address))
+
+	var reasons []string
+	for _, field := range []struct {
+		name  string
+		score float64
+	}{{"name", name}, {"phone", phone}, {"address", address}} {
+		if field.score >= matchingPolicy.FieldMatch {
+			reasons = append(reasons, field.name)
+		}
+	}
+	return matchingPolicy.NameWeight*name + matchingPolicy.PhoneWeight*phone + matchingPolicy.AddressWeight*address, reasons
+}
+
+// Common abbreviations in addresses, spelled out so that '12 Elm St' matches '12 Elm Street'
+var addressAbbreviations = map[string]string{
+	"st": "street", "rd": "road", "ave": "avenue", "blvd": "boulevard", "ln": "lane", "dr": "drive", "apt": "apartment",
+}
+
+// normalise lowercases a value, drops punctuation and spells out address abbreviations
+func normalise(value string) string {
+	words := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		if spelled, ok := addressAbbreviations[word]; ok {
+			words[i] = spelled
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// phoneDigits keeps the last nine digits of a phone number, so that a number matches with or without
+// its country or trunk prefix
+func phoneDigits(phone string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, phone)
+	if len(digits) > 9 {
+		digits = digits[len(digits)-9:]
+	}
+	return digits
+}
+
+// similarity is one minus the edit distance between two values over the length of the longer one
+func similarity(a string, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 0
+	}
+
+	// Levenshtein distance, keeping one row of the table at a time
+	row := make([]int, len(rb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			next := min(row[j]+1, row[j-1]+1, diagonal+cost)
+			diagonal, row[j] = row[j], next
+		}
+	}
+	return 1 - float64(row[len(rb)])/float64(longest)
+}
+
+// tokenOverlap is the share of the words of two values they have in common
+func tokenOverlap(a string, b string) float64 {
+	wordsA, wordsB := map[string]bool{}, map[string]bool{}
+	for _, word := range strings.Fields(a) {
+		wordsA[word] = true
+	}
+	for _, word := range strings.Fields(b) {
+		wordsB[word] = true
+	}
+	common := 0
+	for word := range wordsA {
+		if wordsB[word] {
+			common++
+		}
+	}
+	all := len(wordsA) + len(wordsB) - common
+	if all == 0 {
+		return 0
+	}
+	return float64(common) / float64(all)
+}
@@ -0,0 +1,103 @@
+package Applicant_Erasure
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Applications"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+)
+
+// RetentionPolicy decides when the personal data of an applicant may be erased. Loan submits, payments
+// and the other financial records are kept whatever the policy, erasure only takes away who the
+// applicant was.
+type RetentionPolicy struct {
+	// Months the parties of a loan must stay identifiable after it was closed, by loan status. A loan
+	// in a status not listed, such as 'ongoing', holds up erasure for as long as it is in it.
+	RetentionMonths map[string]int
+	// Applications in these statuses are still being decided and hold up erasure
+	OpenApplicationStatuses []string
+	// Types of document deleted on erasure, documents of other types such as signed contracts are kept
+	// with the loan records
+	ErasedDocumentTypes []string
+}
+
+// RetentionDecision is whether the personal data of an applicant may be erased as of a date, and if not
+// what holds it up. RetainUntil is the date the last retention period of their closed loans ends.
+type RetentionDecision struct {
+	ApplicantID int
+	Allowed     bool
+	Reasons     []string
+	RetainUntil string `json:",omitempty"`
+}
+
+var retentionPolicy RetentionPolicy
+
+func readRetentionPolicyFromFile(filename string) (RetentionPolicy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return RetentionPolicy{}, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var policy RetentionPolicy
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&policy); err != nil {
+		return RetentionPolicy{}, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	for status, months := range policy.RetentionMonths {
+		if months < 0 {
+			return RetentionPolicy{}, fmt.Errorf("invalid retention policy: RetentionMonths of '%s' loans must not be negative", status)
+		}
+	}
+	return policy, nil
+}
+
+// EvaluateRetention decides whether the personal data of an applicant may be erased as of a date. Every
+// loan the applicant is a party of, in any role, must have been closed for as long as the policy keeps
+// loans in its status, and none of their applications may still be open. A loan counts as closed on
+// the day it was last updated, so its retention period is never cut short.
+func EvaluateRetention(applicantID int, asOf time.Time) (RetentionDecision, error) {
+	decision := RetentionDecision{ApplicantID: applicantID, Reasons: []string{}}
+	asOf = time.Date(asOf.Year(), asOf.Month(), asOf.Day(), 0, 0, 0, 0, time.UTC)
+
+	loans, err := Loan_Submits.ApplicantLoans(applicantID)
+	if err != nil {
+		return RetentionDecision{}, err
+	}
+	var retainUntil time.Time
+	for _, loan := range loans {
+		months, ok := retentionPolicy.RetentionMonths[loan.LoanStatus]
+		if !ok {
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("Loan submission %d is %s", loan.LoanSubmitID, loan.LoanStatus))
+			continue
+		}
+		closed := time.Date(loan.UpdatedAt.Year(), loan.UpdatedAt.Month(), loan.UpdatedAt.Day(), 0, 0, 0, 0, time.UTC)
+		until := closed.AddDate(0, months, 0)
+		if until.After(retainUntil) {
+			retainUntil = until
+		}
+		if until.After(asOf) {
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("Loan submission %d is %s and kept on record until %s",
+				loan.LoanSubmitID, loan.LoanStatus, until.Format("2006-01-02")))
+		}
+	}
+	if !retainUntil.IsZero() {
+		decision.RetainUntil = retainUntil.Format("2006-01-02")
+	}
+
+	if len(retentionPolicy.OpenApplicationStatuses) > 0 {
+		applicationIDs, err := Loan_Applications.ApplicationsInStatus(applicantID, retentionPolicy.OpenApplicationStatuses)
+		if err != nil {
+			return RetentionDecision{}, err
+		}
+		for _, applicationID := range applicationIDs {
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("Loan application %d is still open", applicationID))
+		}
+	}
+
+	decision.Allowed = len(decision.Reasons) == 0
+	return decision, nil
+}
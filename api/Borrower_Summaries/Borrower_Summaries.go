@@ -0,0 +1,186 @@
+package Borrower_Summaries
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Credit_Scores"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Applicants"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/SupachotT/Loan_Management_System.git/api/PII_Masking"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+)
+
+// BorrowerSummary brings together what is held about a borrower: who they are, the loans they are a
+// party of and their latest credit score, if they have been scored. Callers who may not see personal
+// data get the applicant masked and the score without its factors.
+type BorrowerSummary struct {
+	Applicant   Loan_Applicants.Loan_applicants
+	Loans       []BorrowerLoan
+	CreditScore *Credit_Scores.CreditScore `json:",omitempty"`
+}
+
+// BorrowerLoan is a loan submit a borrower is a party of, with the role they hold on it
+type BorrowerLoan struct {
+	LoanSubmitID       int
+	PartyRole          string
+	LoanStatus         string
+	LoanAmount         decimal.Decimal
+	OutstandingBalance decimal.Decimal
+	LoanDate           Loan_Submits.CustomDate
+	DueDate            Loan_Submits.CustomDate
+}
+
+// summarizeBorrower puts together the summary of an applicant, shaped for a caller who may or may not
+// see personal data in full
+func summarizeBorrower(applicant Loan_Applicants.Loan_applicants, unmask bool) (BorrowerSummary, error) {
+	summary := BorrowerSummary{Applicant: applicant, Loans: []BorrowerLoan{}}
+
+	partyLoans, err := Loan_Submits.ApplicantLoans(applicant.Applicant_id)
+	if err != nil {
+		return BorrowerSummary{}, err
+	}
+	for _, partyLoan := range partyLoans {
+		loanSubmit, err := Loan_Submits.FindLoanSubmit(partyLoan.LoanSubmitID)
+		if err != nil {
+			return BorrowerSummary{}, err
+		}
+		summary.Loans = append(summary.Loans, BorrowerLoan{
+			LoanSubmitID:       loanSubmit.LoanSubmitID,
+			PartyRole:          partyLoan.PartyRole,
+			LoanStatus:         loanSubmit.LoanStatus,
+			LoanAmount:         loanSubmit.LoanAmount,
+			OutstandingBalance: loanSubmit.OutstandingBalance,
+			LoanDate:           loanSubmit.LoanDate,
+			DueDate:            loanSubmit.DueDate,
+		})
+	}
+
+	creditScore, err := Credit_Scores.LatestScore(applicant.Applicant_id)
+	if err == nil {
+		summary.CreditScore = &creditScore
+	} else if err != sql.ErrNoRows {
+		return BorrowerSummary{}, err
+	}
+
+	if !unmask {
+		Loan_Applicants.MaskApplicant(&summary.Applicant)
+		if summary.CreditScore != nil {
+			summary.CreditScore.Factors = nil
+		}
+	}
+	return summary, nil
+}
+
+func GetBorrowerSummary(w http.ResponseWriter, r *http.Request) {
+	// Extract applicant_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Applicant ID", http.StatusBadRequest)
+		return
+	}
+
+	applicant, err := Loan_Applicants.FindApplicant(id)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_applicants data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A summary produced to be sent out for a purpose, such as an e-statement, needs the borrower's
+	// consent to it
+	if purpose := r.URL.Query().Get("purpose"); purpose != "" {
+		if status, err := checkConsent(applicant.Applicant_id, purpose); err != nil {
+			if status == http.StatusInternalServerError {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			errorResponse := map[string]string{"error": err.Error()}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(errorResponse)
+			return
+		}
+	}
+
+	summary, err := summarizeBorrower(applicant, PII_Masking.CanUnmask(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// checkConsent makes sure an applicant consents to a purpose their data is used for and returns the
+// HTTP status to answer with when they don't
+func checkConsent(applicantID int, purpose string) (int, error) {
+	if !Loan_Applicants.IsConsentPurpose(purpose) {
+		return http.StatusBadRequest, fmt.Errorf("Unknown consent purpose '%s'", purpose)
+	}
+	consented, err := Loan_Applicants.HasConsent(applicantID, purpose)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !consented {
+		return http.StatusForbidden, fmt.Errorf("Applicant %d doesn't consent to '%s'", applicantID, purpose)
+	}
+	return http.StatusOK, nil
+}
+
+// ExportBorrowers exports the summaries of every applicant who is a party of a loan and consents to the
+// purpose of the export, such as 'credit_bureau_sharing'. Anonymized applicants are left out.
+func ExportBorrowers(w http.ResponseWriter, r *http.Request) {
+	purpose := r.URL.Query().Get("purpose")
+	if !Loan_Applicants.IsConsentPurpose(purpose) {
+		errorResponse := map[string]string{"error": fmt.Sprintf("An export needs the consent purpose it is made for, '%s' isn't one", purpose)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	applicants, err := Loan_Applicants.ListApplicants()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	unmask := PII_Masking.CanUnmask(r)
+
+	summaries := []BorrowerSummary{}
+	for _, applicant := range applicants {
+		consented, err := Loan_Applicants.HasConsent(applicant.Applicant_id, purpose)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !consented {
+			continue
+		}
+		summary, err := summarizeBorrower(applicant, unmask)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(summary.Loans) == 0 {
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
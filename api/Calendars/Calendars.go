@@ -0,0 +1,375 @@
+package Calendars
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Business day conventions moving a date that isn't a business day. 'following' moves it to the next
+// business day, 'preceding' to the previous one and 'modified_following' to the next one unless that
+// falls in the next month, in which case it moves to the previous one.
+const (
+	ConventionNone              = "none"
+	ConventionFollowing         = "following"
+	ConventionModifiedFollowing = "modified_following"
+	ConventionPreceding         = "preceding"
+)
+
+// Holiday is a day on which no business is done. AddedOn and RemovedOn record when the holiday was
+// added to and removed from the calendar, they are empty for the holidays it was first loaded with.
+type Holiday struct {
+	Date      string
+	Name      string
+	AddedOn   string `json:",omitempty"`
+	RemovedOn string `json:",omitempty"`
+}
+
+// WeekendChange records the weekend days a calendar had until the day they were changed
+type WeekendChange struct {
+	Until    string
+	Weekends []string
+}
+
+// Calendar lists the weekend days and holidays of a market, loaded from json/calendars/<Name>.json.
+// Changes are kept with the calendar, so that it can be read as it was known on an earlier date.
+type Calendar struct {
+	Name           string
+	Weekends       []string
+	Holidays       []Holiday
+	WeekendChanges []WeekendChange `json:",omitempty"`
+}
+
+const calendarDir = "json/calendars"
+
+var calendarNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,20}$`)
+
+// LoadCalendar reads the calendar with the given name from its file
+func LoadCalendar(name string) (Calendar, error) {
+	if !calendarNamePattern.MatchString(name) {
+		return Calendar{}, fmt.Errorf("invalid calendar name '%s'", name)
+	}
+
+	file, err := os.Open(filepath.Join(calendarDir, name+".json"))
+	if err != nil {
+		return Calendar{}, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	var calendar Calendar
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&calendar); err != nil {
+		return Calendar{}, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	calendar.Name = name
+	if err := validateCalendar(calendar); err != nil {
+		return Calendar{}, fmt.Errorf("invalid calendar '%s': %v", name, err)
+	}
+	return calendar, nil
+}
+
+// validateCalendar checks that the weekend days are names of weekdays and that every holiday has a
+// valid date, leaving at least one business day in the week
+func validateCalendar(calendar Calendar) error {
+	weekdays := make(map[string]bool)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		weekdays[day.String()] = true
+	}
+	weekends := make(map[string]bool)
+	for _, weekend := range calendar.Weekends {
+		if !weekdays[weekend] {
+			return fmt.Errorf("invalid weekend day '%s'. Expected a weekday name such as 'Saturday'", weekend)
+		}
+		weekends[weekend] = true
+	}
+	if len(weekends) == len(weekdays) {
+		return fmt.Errorf("a calendar must have at least one business day in the week")
+	}
+	for _, holiday := range calendar.Holidays {
+		if _, err := time.Parse("2006-01-02", holiday.Date); err != nil {
+			return fmt.Errorf("invalid holiday date '%s'. Expected format is YYYY-MM-DD", holiday.Date)
+		}
+		if holiday.Name == "" {
+			return fmt.Errorf("holiday on %s must have a Name", holiday.Date)
+		}
+		for _, changed := range []string{holiday.AddedOn, holiday.RemovedOn} {
+			if _, err := time.Parse("2006-01-02", changed); changed != "" && err != nil {
+				return fmt.Errorf("invalid change date '%s' of holiday on %s. Expected format is YYYY-MM-DD", changed, holiday.Date)
+			}
+		}
+	}
+	return nil
+}
+
+// AsOf returns the calendar as it was known on the given date. The due date and grace period of an
+// installment are counted in the calendar as known on its due date, so a later change of the calendar
+// only moves the installments that fall due after it.
+func (calendar Calendar) AsOf(date time.Time) Calendar {
+	day := date.Format("2006-01-02")
+	known := Calendar{Name: calendar.Name, Weekends: calendar.Weekends}
+	for _, change := range calendar.WeekendChanges {
+		if day < change.Until {
+			known.Weekends = change.Weekends
+			break
+		}
+	}
+	for _, holiday := range calendar.Holidays {
+		if (holiday.AddedOn == "" || holiday.AddedOn <= day) && (holiday.RemovedOn == "" || day < holiday.RemovedOn) {
+			known.Holidays = append(known.Holidays, Holiday{Date: holiday.Date, Name: holiday.Name})
+		}
+	}
+	return known
+}
+
+// mergeChanges records the changes an update makes to the current calendar with the updated one. New
+// holidays are added today and missing ones removed today, a holiday added and removed on the same day
+// leaves no trace. The weekends the current calendar had are kept until today when they change.
+func mergeChanges(current Calendar, updated Calendar, today string) Calendar {
+	active := make(map[string]Holiday)
+	var holidays []Holiday
+	for _, holiday := range current.Holidays {
+		if holiday.RemovedOn != "" {
+			holidays = append(holidays, holiday)
+			continue
+		}
+		active[holiday.Date] = holiday
+	}
+
+	kept := make(map[string]bool)
+	for _, holiday := range updated.Holidays {
+		if kept[holiday.Date] {
+			continue
+		}
+		kept[holiday.Date] = true
+		if previous, ok := active[holiday.Date]; ok {
+			holidays = append(holidays, Holiday{Date: holiday.Date, Name: holiday.Name, AddedOn: previous.AddedOn})
+		} else {
+			holidays = append(holidays, Holiday{Date: holiday.Date, Name: holiday.Name, AddedOn: today})
+		}
+	}
+	for _, holiday := range current.Holidays {
+		if holiday.RemovedOn != "" || kept[holiday.Date] || holiday.AddedOn == today {
+			continue
+		}
+		holiday.RemovedOn = today
+		holidays = append(holidays, holiday)
+	}
+	sort.SliceStable(holidays, func(i, j int) bool { return holidays[i].Date < holidays[j].Date })
+
+	merged := Calendar{Name: updated.Name, Weekends: updated.Weekends, Holidays: holidays, WeekendChanges: current.WeekendChanges}
+	if !sameDays(current.Weekends, updated.Weekends) {
+		last := len(merged.WeekendChanges) - 1
+		if last < 0 || merged.WeekendChanges[last].Until != today {
+			merged.WeekendChanges = append(merged.WeekendChanges, WeekendChange{Until: today, Weekends: current.Weekends})
+		}
+	}
+	return merged
+}
+
+func sameDays(days []string, other []string) bool {
+	set := make(map[string]bool)
+	for _, day := range days {
+		set[day] = true
+	}
+	otherSet := make(map[string]bool)
+	for _, day := range other {
+		if !set[day] {
+			return false
+		}
+		otherSet[day] = true
+	}
+	return len(set) == len(otherSet)
+}
+
+// saveCalendar replaces the file of the calendar, writing to a temporary file first so that a failed
+// write never leaves a truncated calendar behind
+func saveCalendar(calendar Calendar) error {
+	data, err := json.MarshalIndent(calendar, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error encoding JSON: %v", err)
+	}
+	path := filepath.Join(calendarDir, calendar.Name+".json")
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return nil
+}
+
+// ValidConvention reports whether the given business day convention is known
+func ValidConvention(convention string) bool {
+	switch convention {
+	case ConventionNone, ConventionFollowing, ConventionModifiedFollowing, ConventionPreceding:
+		return true
+	}
+	return false
+}
+
+// IsBusinessDay reports whether the given date is neither a weekend day nor a holiday
+func (calendar Calendar) IsBusinessDay(date time.Time) bool {
+	weekday := date.Weekday().String()
+	for _, weekend := range calendar.Weekends {
+		if weekend == weekday {
+			return false
+		}
+	}
+	day := date.Format("2006-01-02")
+	for _, holiday := range calendar.Holidays {
+		if holiday.Date == day && holiday.RemovedOn == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Adjust moves a date that isn't a business day according to the given convention
+func (calendar Calendar) Adjust(date time.Time, convention string) time.Time {
+	switch convention {
+	case ConventionFollowing:
+		return calendar.step(date, 1)
+	case ConventionPreceding:
+		return calendar.step(date, -1)
+	case ConventionModifiedFollowing:
+		if following := calendar.step(date, 1); following.Month() == date.Month() {
+			return following
+		}
+		return calendar.step(date, -1)
+	}
+	return date
+}
+
+// AddBusinessDays returns the date the given number of business days after date. Without weekends or
+// holidays this is the same as adding calendar days.
+func (calendar Calendar) AddBusinessDays(date time.Time, days int) time.Time {
+	for days > 0 {
+		date = date.AddDate(0, 0, 1)
+		if calendar.IsBusinessDay(date) {
+			days--
+		}
+	}
+	return date
+}
+
+// step moves day by day in the given direction until it reaches a business day. A calendar with
+// every day of the week as weekend has no business days, so the date is returned as it is.
+func (calendar Calendar) step(date time.Time, direction int) time.Time {
+	day := date
+	for i := 0; i < 366; i++ {
+		if calendar.IsBusinessDay(day) {
+			return day
+		}
+		day = day.AddDate(0, 0, direction)
+	}
+	return date
+}
+
+func GetCalendar(w http.ResponseWriter, r *http.Request) {
+	// Extract the calendar name from request parameters
+	vars := mux.Vars(r)
+	calendar, err := LoadCalendar(vars["name"])
+	if os.IsNotExist(errors.Unwrap(err)) {
+		errorResponse := map[string]string{"error": "calendar not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Answer a business day query for a single date when one is given
+	if day := r.URL.Query().Get("date"); day != "" {
+		date, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			http.Error(w, "Invalid date. Expected format is YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		response := map[string]interface{}{
+			"Calendar":            calendar.Name,
+			"Date":                day,
+			"IsBusinessDay":       calendar.IsBusinessDay(date),
+			"NextBusinessDay":     calendar.Adjust(date, ConventionFollowing).Format("2006-01-02"),
+			"PreviousBusinessDay": calendar.Adjust(date, ConventionPreceding).Format("2006-01-02"),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(calendar)
+}
+
+// calendarUpdates serializes calendar updates, each of which reads the calendar it changes
+var calendarUpdates sync.Mutex
+
+func UpdateCalendar(w http.ResponseWriter, r *http.Request) {
+	// Extract the calendar name from request parameters
+	vars := mux.Vars(r)
+	name := vars["name"]
+	if !calendarNamePattern.MatchString(name) {
+		http.Error(w, fmt.Sprintf("invalid calendar name '%s'", name), http.StatusBadRequest)
+		return
+	}
+
+	// Parse the request body, the whole calendar is replaced
+	var calendar Calendar
+	if err := json.NewDecoder(r.Body).Decode(&calendar); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	calendar.Name = name
+	if err := validateCalendar(calendar); err != nil {
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// The changes take effect from today, the calendar stays as it was known before for the installments
+	// already due
+	calendarUpdates.Lock()
+	defer calendarUpdates.Unlock()
+	current, err := LoadCalendar(name)
+	if err != nil && !os.IsNotExist(errors.Unwrap(err)) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		calendar = mergeChanges(current, calendar, time.Now().Format("2006-01-02"))
+	} else {
+		for i := range calendar.Holidays {
+			calendar.Holidays[i].AddedOn, calendar.Holidays[i].RemovedOn = "", ""
+		}
+		calendar.WeekendChanges = nil
+		sort.Slice(calendar.Holidays, func(i, j int) bool { return calendar.Holidays[i].Date < calendar.Holidays[j].Date })
+	}
+
+	if err := saveCalendar(calendar); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Prepare success message
+	successMessage := map[string]interface{}{
+		"message": fmt.Sprintf("Calendar %s has been successfully updated with %d holidays.", name, len(calendar.Holidays)),
+	}
+
+	// Set Content-Type and return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(successMessage)
+}
@@ -0,0 +1,96 @@
+package Loan_Applicants
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// anonymizedStatus is the applicant_status of an applicant whose personal data has been erased. The
+// applicant stays on record under the same ID for the loans and payments that refer to them.
+const anonymizedStatus = "anonymized"
+
+// Anonymized reports whether the personal data of an applicant has been erased
+func (applicant Loan_applicants) Anonymized() bool {
+	return applicant.Applicant_Status == anonymizedStatus
+}
+
+// ErrApplicantReferenced is returned by a delete hook when records kept elsewhere still refer to the
+// applicant, who can then only be anonymized
+var ErrApplicantReferenced = errors.New("applicant is still referred to")
+
+// DeleteHook is run before an applicant is deleted and stops the delete by returning an error
+type DeleteHook func(applicantID int) error
+
+var deleteHooks []DeleteHook
+
+// BeforeDelete registers a hook run before an applicant is deleted, such as a check that no loan
+// records refer to them
+func BeforeDelete(hook DeleteHook) {
+	deleteHooks = append(deleteHooks, hook)
+}
+
+func runDeleteHooks(applicantID int) error {
+	for _, hook := range deleteHooks {
+		if err := hook(applicantID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AnonymizeApplicant erases the personal data of an applicant: their name and contact details are
+// replaced, the sealed fields hold empty values under a new row key, every version of their profile
+// is deleted and the consents they had granted are withdrawn. It returns how many profile versions
+// were deleted, or sql.ErrNoRows if the applicant doesn't exist. An applicant may be anonymized
+// again, which only seals the empty fields anew.
+func AnonymizeApplicant(id int) (int64, error) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the applicant so that a profile can't be added while it is erased
+	var applicantID int
+	err = tx.QueryRow(`SELECT applicant_id FROM loan_applicants WHERE applicant_id = $1 FOR UPDATE`, id).Scan(&applicantID)
+	if err != nil {
+		return 0, err
+	}
+
+	// The email is sealed empty like the other fields, without a blind index nothing can find it
+	sealed, err := sealApplicant(Loan_applicants{})
+	if err != nil {
+		return 0, err
+	}
+	query := `UPDATE loan_applicants SET first_name = 'Anonymized', last_name = 'Applicant', applicant_status = $2, address = $3, phone = $4,
+		email = $5, email_index = NULL, key_id = $6, data_key = $7, updated_at = CURRENT_TIMESTAMP WHERE applicant_id = $1`
+	if _, err := tx.Exec(query, id, anonymizedStatus, sealed[0], sealed[1], sealed[2], sealed[4], sealed[5]); err != nil {
+		return 0, fmt.Errorf("error anonymizing applicant %d: %v", id, err)
+	}
+	result, err := tx.Exec(`DELETE FROM applicant_profiles WHERE applicant_id = $1`, id)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting profiles of applicant %d: %v", id, err)
+	}
+	profiles, _ := result.RowsAffected()
+	if err := withdrawConsents(tx, id, "erasure", "erasure"); err != nil {
+		return 0, err
+	}
+	return profiles, tx.Commit()
+}
+
+// isAnonymized reports whether an applicant has been anonymized, false if they don't exist
+func isAnonymized(db *sql.DB, id int) (bool, error) {
+	var status string
+	err := db.QueryRow(`SELECT applicant_status FROM loan_applicants WHERE applicant_id = $1`, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return status == anonymizedStatus, err
+}
@@ -0,0 +1,471 @@
+package Loan_Applicants
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ConsentPurpose is something applicants are asked to consent to, with every version of the consent
+// text by version number. Consent given to a text older than RequiredVersion no longer counts, as when
+// the text changed enough that applicants must be asked again.
+type ConsentPurpose struct {
+	Texts           map[int]string
+	RequiredVersion int
+}
+
+// ConsentPolicy lists the purposes applicants are asked to consent to, such as 'marketing',
+// 'credit_bureau_sharing' and 'e_statements'
+type ConsentPolicy struct {
+	Purposes map[string]ConsentPurpose
+}
+
+// ApplicantConsent is the consent of an applicant to one purpose, given or withdrawn against version
+// TextVersion of its text. Every change is kept and the latest for a purpose is the one that holds.
+// Effective and CurrentTextVersion are only set on the current consents: whether the consent counts
+// under the policy, and the text applicants are asked to agree to now.
+type ApplicantConsent struct {
+	ApplicantID        int
+	Purpose            string
+	Granted            bool
+	TextVersion        int
+	Source             string
+	RecordedBy         string
+	RecordedAt         string
+	Effective          bool `json:",omitempty"`
+	CurrentTextVersion int  `json:",omitempty"`
+}
+
+// ConsentChoice is one consent given or withdrawn in a ConsentUpdate. A withdrawal without a
+// TextVersion is recorded against the current text.
+type ConsentChoice struct {
+	Purpose     string
+	Granted     bool
+	TextVersion int
+}
+
+// ConsentUpdate is the body of a consent update, with where the consents were collected, such as
+// 'web', 'branch' or 'call_center', and who recorded them
+type ConsentUpdate struct {
+	Consents   []ConsentChoice
+	Source     string
+	RecordedBy string
+}
+
+var consentPolicy ConsentPolicy
+
+// Columns selected into an ApplicantConsent by scanApplicantConsent
+const applicantConsentColumns = `applicant_id, purpose, granted, text_version, source, recorded_by, recorded_at`
+
+func scanApplicantConsent(row interface{ Scan(...interface{}) error }, consent *ApplicantConsent) error {
+	return row.Scan(&consent.ApplicantID, &consent.Purpose, &consent.Granted, &consent.TextVersion, &consent.Source, &consent.RecordedBy, &consent.RecordedAt)
+}
+
+func createApplicantConsentTable(db *sql.DB) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS applicant_consents (
+			consent_id SERIAL PRIMARY KEY,
+			applicant_id INT NOT NULL REFERENCES loan_applicants (applicant_id) ON DELETE CASCADE,
+			purpose VARCHAR(30) NOT NULL,
+			granted BOOLEAN NOT NULL,
+			text_version INT NOT NULL,
+			source VARCHAR(20) NOT NULL,
+			recorded_by VARCHAR(50) NOT NULL,
+			recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS applicant_consents_latest ON applicant_consents (applicant_id, purpose, consent_id DESC)`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("error creating applicant_consents table: %v", err)
+		}
+	}
+	return nil
+}
+
+func readConsentPolicyFromFile(filename string) (ConsentPolicy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return ConsentPolicy{}, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var policy ConsentPolicy
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&policy); err != nil {
+		return ConsentPolicy{}, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	for name, purpose := range policy.Purposes {
+		if _, ok := purpose.Texts[purpose.RequiredVersion]; !ok {
+			return ConsentPolicy{}, fmt.Errorf("invalid consent policy: RequiredVersion %d of '%s' has no text", purpose.RequiredVersion, name)
+		}
+	}
+	return policy, nil
+}
+
+// currentVersion is the latest version of the text of a purpose
+func (purpose ConsentPurpose) currentVersion() int {
+	current := 0
+	for version := range purpose.Texts {
+		if version > current {
+			current = version
+		}
+	}
+	return current
+}
+
+// validateConsentUpdate checks the consents of an update and fills in the text version of withdrawals
+func validateConsentUpdate(update *ConsentUpdate) error {
+	switch {
+	case len(update.Consents) == 0:
+		return fmt.Errorf("Consents is required")
+	case update.Source == "":
+		return fmt.Errorf("Source is required")
+	case update.RecordedBy == "":
+		return fmt.Errorf("RecordedBy is required")
+	}
+	seen := map[string]bool{}
+	for i, choice := range update.Consents {
+		purpose, ok := consentPolicy.Purposes[choice.Purpose]
+		switch {
+		case !ok:
+			return fmt.Errorf("Unknown consent Purpose: '%s'", choice.Purpose)
+		case seen[choice.Purpose]:
+			return fmt.Errorf("Consent to '%s' is given more than once", choice.Purpose)
+		case !choice.Granted && choice.TextVersion == 0:
+			update.Consents[i].TextVersion = purpose.currentVersion()
+		case purpose.Texts[choice.TextVersion] == "":
+			return fmt.Errorf("Consent text version %d of '%s' doesn't exist", choice.TextVersion, choice.Purpose)
+		case choice.Granted && choice.TextVersion < purpose.RequiredVersion:
+			return fmt.Errorf("Consent to '%s' must be given to text version %d or later", choice.Purpose, purpose.RequiredVersion)
+		}
+		seen[choice.Purpose] = true
+	}
+	return nil
+}
+
+// effective reports whether a consent counts under the consent policy
+func (consent ApplicantConsent) effective() bool {
+	purpose, ok := consentPolicy.Purposes[consent.Purpose]
+	return ok && consent.Granted && consent.TextVersion >= purpose.RequiredVersion
+}
+
+// currentConsents returns the latest consent of an applicant to every purpose of the consent policy,
+// those never given are shown as not granted
+func currentConsents(db *sql.DB, applicantID int) ([]ApplicantConsent, error) {
+	query := "SELECT DISTINCT ON (purpose) " + applicantConsentColumns + " FROM applicant_consents WHERE applicant_id = $1 ORDER BY purpose, consent_id DESC"
+	rows, err := db.Query(query, applicantID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying consents: %v", err)
+	}
+	defer rows.Close()
+
+	latest := map[string]ApplicantConsent{}
+	for rows.Next() {
+		var consent ApplicantConsent
+		if err := scanApplicantConsent(rows, &consent); err != nil {
+			return nil, err
+		}
+		latest[consent.Purpose] = consent
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var purposes []string
+	for name := range consentPolicy.Purposes {
+		purposes = append(purposes, name)
+	}
+	sort.Strings(purposes)
+	consents := []ApplicantConsent{}
+	for _, name := range purposes {
+		consent, ok := latest[name]
+		if !ok {
+			consent = ApplicantConsent{ApplicantID: applicantID, Purpose: name}
+		}
+		consent.Effective = consent.effective()
+		consent.CurrentTextVersion = consentPolicy.Purposes[name].currentVersion()
+		consents = append(consents, consent)
+	}
+	return consents, nil
+}
+
+// IsConsentPurpose reports whether applicants are asked to consent to a purpose
+func IsConsentPurpose(purpose string) bool {
+	_, ok := consentPolicy.Purposes[purpose]
+	return ok
+}
+
+// HasConsent reports whether an applicant currently consents to a purpose, which exports and anything
+// else sent out about an applicant must check before using their data for it. Anonymized applicants
+// consent to nothing, their consents were withdrawn.
+func HasConsent(applicantID int, purpose string) (bool, error) {
+	if !IsConsentPurpose(purpose) {
+		return false, fmt.Errorf("unknown consent purpose '%s'", purpose)
+	}
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var consent ApplicantConsent
+	query := "SELECT " + applicantConsentColumns + " FROM applicant_consents WHERE applicant_id = $1 AND purpose = $2 ORDER BY consent_id DESC LIMIT 1"
+	err = scanApplicantConsent(db.QueryRow(query, applicantID, purpose), &consent)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error querying consent of applicant %d: %v", applicantID, err)
+	}
+	return consent.effective(), nil
+}
+
+// ConsentingApplicants returns the applicants who currently consent to a purpose, for notifications and
+// exports sent to many applicants at once. Anonymized applicants consent to nothing.
+func ConsentingApplicants(purpose string) ([]int, error) {
+	policy, ok := consentPolicy.Purposes[purpose]
+	if !ok {
+		return nil, fmt.Errorf("unknown consent purpose '%s'", purpose)
+	}
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	query := `SELECT c.applicant_id FROM (SELECT DISTINCT ON (applicant_id) applicant_id, granted, text_version FROM applicant_consents
+			WHERE purpose = $1 ORDER BY applicant_id, consent_id DESC) c
+		JOIN loan_applicants a ON a.applicant_id = c.applicant_id
+		WHERE c.granted AND c.text_version >= $2 AND a.applicant_status <> $3 ORDER BY c.applicant_id`
+	rows, err := db.Query(query, purpose, policy.RequiredVersion, anonymizedStatus)
+	if err != nil {
+		return nil, fmt.Errorf("error querying consenting applicants: %v", err)
+	}
+	defer rows.Close()
+
+	var applicantIDs []int
+	for rows.Next() {
+		var applicantID int
+		if err := rows.Scan(&applicantID); err != nil {
+			return nil, err
+		}
+		applicantIDs = append(applicantIDs, applicantID)
+	}
+	return applicantIDs, rows.Err()
+}
+
+// withdrawConsents records the withdrawal of every consent an applicant has granted, against the text
+// they granted it to
+func withdrawConsents(tx *sql.Tx, applicantID int, source string, recordedBy string) error {
+	query := `INSERT INTO applicant_consents (applicant_id, purpose, granted, text_version, source, recorded_by)
+		SELECT applicant_id, purpose, FALSE, text_version, $2, $3 FROM (SELECT DISTINCT ON (purpose) applicant_id, purpose, granted, text_version
+			FROM applicant_consents WHERE applicant_id = $1 ORDER BY purpose, consent_id DESC) c
+		WHERE c.granted`
+	if _, err := tx.Exec(query, applicantID, source, recordedBy); err != nil {
+		return fmt.Errorf("error withdrawing consents of applicant %d: %v", applicantID, err)
+	}
+	return nil
+}
+
+// consentApplicantID extracts the applicant_id from request parameters and makes sure the applicant exists
+func consentApplicantID(w http.ResponseWriter, r *http.Request, db *sql.DB) (int, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid applicant ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var applicantID int
+	err = db.QueryRow(`SELECT applicant_id FROM loan_applicants WHERE applicant_id = $1`, id).Scan(&applicantID)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "applicant not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return 0, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	return id, true
+}
+
+func GetApplicantConsents(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	id, ok := consentApplicantID(w, r, db)
+	if !ok {
+		return
+	}
+	consents, err := currentConsents(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(consents)
+}
+
+// GetConsentingApplicants lists the applicants who currently consent to a purpose, the only ones the
+// notification and export services may use their data for it
+func GetConsentingApplicants(w http.ResponseWriter, r *http.Request) {
+	purpose := mux.Vars(r)["purpose"]
+	if _, ok := consentPolicy.Purposes[purpose]; !ok {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Unknown consent purpose '%s'", purpose)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+	applicantIDs, err := ConsentingApplicants(purpose)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if applicantIDs == nil {
+		applicantIDs = []int{}
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Purpose":      purpose,
+		"ApplicantIDs": applicantIDs,
+	})
+}
+
+func GetApplicantConsentHistory(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	id, ok := consentApplicantID(w, r, db)
+	if !ok {
+		return
+	}
+
+	// Every consent given or withdrawn, the latest first
+	rows, err := db.Query("SELECT "+applicantConsentColumns+" FROM applicant_consents WHERE applicant_id = $1 ORDER BY consent_id DESC", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	consents := []ApplicantConsent{}
+	for rows.Next() {
+		var consent ApplicantConsent
+		if err := scanApplicantConsent(rows, &consent); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		consents = append(consents, consent)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(consents)
+}
+
+func UpdateApplicantConsents(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Get applicant_id from URL parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid applicant ID", http.StatusBadRequest)
+		return
+	}
+
+	// Decode JSON request body into a ConsentUpdate struct
+	var update ConsentUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateConsentUpdate(&update); err != nil {
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the applicant so that consents aren't recorded while they are anonymized
+	var applicantStatus string
+	err = tx.QueryRow(`SELECT applicant_status FROM loan_applicants WHERE applicant_id = $1 FOR UPDATE`, id).Scan(&applicantStatus)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "applicant not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if applicantStatus == anonymizedStatus {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Applicant %d has been anonymized", id)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Record every consent given or withdrawn, earlier ones are kept as history
+	query := `INSERT INTO applicant_consents (applicant_id, purpose, granted, text_version, source, recorded_by) VALUES ($1, $2, $3, $4, $5, $6)`
+	for _, choice := range update.Consents {
+		if _, err := tx.Exec(query, id, choice.Purpose, choice.Granted, choice.TextVersion, update.Source, update.RecordedBy); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	consents, err := currentConsents(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(consents)
+}
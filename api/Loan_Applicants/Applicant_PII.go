@@ -0,0 +1,320 @@
+package Loan_Applicants
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/PII_Masking"
+)
+
+// Columns selected into a Loan_applicants by scanApplicant. Address, phone and email are sealed with
+// the row key, email_index is the blind index that keeps emails unique.
+const applicantColumns = `applicant_id, first_name, last_name, address, phone, email, key_id, data_key, applicant_status, created_at, updated_at`
+
+func scanApplicant(row interface{ Scan(...interface{}) error }, applicant *Loan_applicants) error {
+	var address, phone, email, dataKey []byte
+	var keyID string
+	if err := row.Scan(&applicant.Applicant_id, &applicant.First_name, &applicant.Last_name, &address, &phone, &email, &keyID, &dataKey,
+		&applicant.Applicant_Status, &applicant.Created_at, &applicant.Updated_at); err != nil {
+		return err
+	}
+	key, err := openRowKey(keyID, dataKey)
+	if err != nil {
+		return fmt.Errorf("error opening applicant %d: %v", applicant.Applicant_id, err)
+	}
+	for _, field := range []struct {
+		sealed []byte
+		value  *string
+	}{{address, &applicant.Address}, {phone, &applicant.Phone}, {email, &applicant.Email}} {
+		if *field.value, err = key.open(field.sealed); err != nil {
+			return fmt.Errorf("error opening applicant %d: %v", applicant.Applicant_id, err)
+		}
+	}
+	return nil
+}
+
+// MaskApplicant masks the personal data of an applicant for callers who may not see it in full
+func MaskApplicant(applicant *Loan_applicants) {
+	applicant.Address = PII_Masking.MaskAddress(applicant.Address)
+	applicant.Phone = PII_Masking.MaskPhone(applicant.Phone)
+	applicant.Email = PII_Masking.MaskEmail(applicant.Email)
+}
+
+// MaskApplicantProfile masks the identity details of an applicant profile for callers who may not see
+// them in full. Income and employment are left for underwriting.
+func MaskApplicantProfile(profile *ApplicantProfile) {
+	profile.DateOfBirth = PII_Masking.MaskDate(profile.DateOfBirth)
+	profile.NationalID = PII_Masking.MaskNationalID(profile.NationalID)
+}
+
+// sealApplicant seals the personal data of an applicant under a new row key and returns the values of
+// the address, phone, email, email_index, key_id and data_key columns
+func sealApplicant(applicant Loan_applicants) ([]interface{}, error) {
+	key, err := newRowKey()
+	if err != nil {
+		return nil, err
+	}
+	values := []interface{}{}
+	for _, value := range []string{applicant.Address, applicant.Phone, applicant.Email} {
+		sealed, err := key.seal(value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, sealed)
+	}
+	return append(values, blindIndex(applicant.Email), key.keyID, key.dataKey), nil
+}
+
+// migratePlaintextPII moves a loan_applicants table created before its personal data was encrypted
+// over to sealed columns. The plaintext columns are renamed out of the way and dropped once every row
+// has been sealed, so a migration that stopped part way carries on at the next start.
+func migratePlaintextPII(db *sql.DB) error {
+	var dataType string
+	err := db.QueryRow(`SELECT data_type FROM information_schema.columns WHERE table_name = 'loan_applicants' AND column_name = 'email'`).Scan(&dataType)
+	if err != nil {
+		return fmt.Errorf("error inspecting loan_applicants table: %v", err)
+	}
+	if dataType == "character varying" {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		queries := []string{
+			`ALTER TABLE loan_applicants RENAME COLUMN address TO address_plaintext`,
+			`ALTER TABLE loan_applicants RENAME COLUMN phone TO phone_plaintext`,
+			`ALTER TABLE loan_applicants RENAME COLUMN email TO email_plaintext`,
+			`ALTER TABLE loan_applicants ADD COLUMN address BYTEA, ADD COLUMN phone BYTEA, ADD COLUMN email BYTEA,
+				ADD COLUMN email_index BYTEA, ADD COLUMN key_id VARCHAR(64), ADD COLUMN data_key BYTEA`,
+		}
+		for _, query := range queries {
+			if _, err := tx.Exec(query); err != nil {
+				return fmt.Errorf("error migrating loan_applicants table: %v", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	var plaintext bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'loan_applicants' AND column_name = 'email_plaintext')`).Scan(&plaintext)
+	if err != nil || !plaintext {
+		return err
+	}
+
+	sealed := 0
+	for {
+		count, err := sealPlaintextBatch(db)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			break
+		}
+		sealed += count
+	}
+	queries := []string{
+		`ALTER TABLE loan_applicants DROP COLUMN address_plaintext, DROP COLUMN phone_plaintext, DROP COLUMN email_plaintext`,
+		`ALTER TABLE loan_applicants ALTER COLUMN address SET NOT NULL, ALTER COLUMN phone SET NOT NULL, ALTER COLUMN email SET NOT NULL,
+			ALTER COLUMN key_id SET NOT NULL`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("error migrating loan_applicants table: %v", err)
+		}
+	}
+	log.Printf("Encrypted the personal data of %d loan applicants", sealed)
+	return nil
+}
+
+func sealPlaintextBatch(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT applicant_id, address_plaintext, phone_plaintext, email_plaintext FROM loan_applicants WHERE email IS NULL
+		ORDER BY applicant_id LIMIT $1 FOR UPDATE`
+	rows, err := tx.Query(query, fieldEncryption.RotationBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var applicants []Loan_applicants
+	for rows.Next() {
+		var applicant Loan_applicants
+		if err := rows.Scan(&applicant.Applicant_id, &applicant.Address, &applicant.Phone, &applicant.Email); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		applicants = append(applicants, applicant)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, applicant := range applicants {
+		values, err := sealApplicant(applicant)
+		if err != nil {
+			return 0, err
+		}
+		query := `UPDATE loan_applicants SET address = $2, phone = $3, email = $4, email_index = $5, key_id = $6, data_key = $7 WHERE applicant_id = $1`
+		if _, err := tx.Exec(query, append([]interface{}{applicant.Applicant_id}, values...)...); err != nil {
+			return 0, fmt.Errorf("error encrypting applicant %d: %v", applicant.Applicant_id, err)
+		}
+	}
+	return len(applicants), tx.Commit()
+}
+
+// encryptedTables are the tables whose rows are sealed with row keys, and their sealed columns
+var encryptedTables = []struct {
+	table    string
+	idColumn string
+	columns  []string
+}{
+	{"loan_applicants", "applicant_id", []string{"address", "phone", "email"}},
+	{"applicant_profiles", "profile_id", []string{"national_id"}},
+}
+
+// RotateFieldKeys re-encrypts every row sealed under a key other than the active one with a new row key
+// under the active key, one batch of rows per transaction, and returns how many rows it re-encrypted.
+// With newKey it first makes a new key active: a new key in the keyring file, or a new version of the
+// transit key in the KMS. Blind indexes don't change.
+func RotateFieldKeys(newKey bool, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = fieldEncryption.RotationBatchSize
+	}
+	if newKey {
+		if err := activateNewKey(); err != nil {
+			return 0, err
+		}
+	}
+	activeKeyID, err := provider.activeKeyID()
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	rotated := 0
+	for _, table := range encryptedTables {
+		for {
+			count, err := reencryptBatch(db, table.table, table.idColumn, table.columns, activeKeyID, batchSize)
+			if err != nil {
+				return rotated, err
+			}
+			if count == 0 {
+				break
+			}
+			rotated += count
+			log.Printf("Re-encrypted %d rows of %s under key %s", count, table.table, activeKeyID)
+		}
+	}
+	return rotated, nil
+}
+
+// activateNewKey makes a new key-encryption key the active one
+func activateNewKey() error {
+	switch p := provider.(type) {
+	case kmsProvider:
+		return p.call(http.MethodPost, "keys/"+p.settings.KeyName+"/rotate", nil, &struct{}{})
+	default:
+		// A running server picks the new key up by itself when it sees the keyring file replaced
+		current, err := currentKeyring()
+		if err != nil {
+			return err
+		}
+		ring := current
+		ring.Keys = map[string]string{}
+		for id, key := range current.Keys {
+			ring.Keys[id] = key
+		}
+		ring.ActiveKeyID = newKeyID()
+		if _, ok := ring.Keys[ring.ActiveKeyID]; ok {
+			return fmt.Errorf("key %s is already in the keyring", ring.ActiveKeyID)
+		}
+		ring.Keys[ring.ActiveKeyID] = newKeyHex()
+		return writeKeyring(fieldEncryption.KeyringFile, ring)
+	}
+}
+
+// reencryptBatch re-encrypts a batch of the rows of a table not sealed under the active key. Rows
+// locked by a concurrent change are skipped and picked up by a later batch or rotation.
+func reencryptBatch(db *sql.DB, table string, idColumn string, columns []string, activeKeyID string, batchSize int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`SELECT %s, key_id, data_key, %s FROM %s WHERE key_id <> $1 ORDER BY %s LIMIT $2 FOR UPDATE SKIP LOCKED`,
+		idColumn, strings.Join(columns, ", "), table, idColumn)
+	rows, err := tx.Query(query, activeKeyID, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("error selecting %s to re-encrypt: %v", table, err)
+	}
+	type sealedRow struct {
+		id      int
+		keyID   string
+		dataKey []byte
+		fields  [][]byte
+	}
+	var batch []sealedRow
+	for rows.Next() {
+		row := sealedRow{fields: make([][]byte, len(columns))}
+		dest := []interface{}{&row.id, &row.keyID, &row.dataKey}
+		for i := range row.fields {
+			dest = append(dest, &row.fields[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var assignments []string
+	for i, column := range columns {
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", column, i+4))
+	}
+	update := fmt.Sprintf(`UPDATE %s SET key_id = $2, data_key = $3, %s WHERE %s = $1`, table, strings.Join(assignments, ", "), idColumn)
+	for _, row := range batch {
+		oldKey, err := openRowKey(row.keyID, row.dataKey)
+		if err != nil {
+			return 0, fmt.Errorf("error opening %s %d: %v", table, row.id, err)
+		}
+		newKey, err := newRowKey()
+		if err != nil {
+			return 0, err
+		}
+		args := []interface{}{row.id, newKey.keyID, newKey.dataKey}
+		for _, field := range row.fields {
+			plaintext, err := oldKey.open(field)
+			if err != nil {
+				return 0, fmt.Errorf("error opening %s %d: %v", table, row.id, err)
+			}
+			sealed, err := newKey.seal(plaintext)
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, sealed)
+		}
+		if _, err := tx.Exec(update, args...); err != nil {
+			return 0, fmt.Errorf("error re-encrypting %s %d: %v", table, row.id, err)
+		}
+	}
+	return len(batch), tx.Commit()
+}
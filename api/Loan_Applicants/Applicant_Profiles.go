@@ -0,0 +1,358 @@
+package Loan_Applicants
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/PII_Masking"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+)
+
+// ApplicantProfile holds the identity, income and employment details underwriting needs about an
+// applicant. Every change is kept as a new version, so the income an applicant declared at any time
+// can be traced. The national ID is stored encrypted. ChangedBy is the holder of the API token the
+// change was made with, whatever the body of the request says.
+type ApplicantProfile struct {
+	ApplicantID      int
+	Version          int
+	DateOfBirth      string // YYYY-MM-DD
+	NationalID       string // 13-digit Thai national ID number
+	MonthlyIncome    decimal.Decimal
+	EmploymentStatus string
+	EmployerName     string
+	EmploymentMonths int
+	ChangedBy        string
+	ChangeReason     string
+	CreatedAt        string
+}
+
+// Applicants must have reached the age of majority under Thai law
+const minimumApplicantAge = 20
+
+// Columns selected into an ApplicantProfile by scanApplicantProfile
+const applicantProfileColumns = `applicant_id, version, to_char(date_of_birth, 'YYYY-MM-DD'), national_id, key_id, data_key, monthly_income,
+	employment_status, employer_name, employment_months, changed_by, change_reason, created_at`
+
+func scanApplicantProfile(row interface{ Scan(...interface{}) error }, profile *ApplicantProfile) error {
+	var nationalID, dataKey []byte
+	var keyID string
+	if err := row.Scan(&profile.ApplicantID, &profile.Version, &profile.DateOfBirth, &nationalID, &keyID, &dataKey, &profile.MonthlyIncome,
+		&profile.EmploymentStatus, &profile.EmployerName, &profile.EmploymentMonths, &profile.ChangedBy, &profile.ChangeReason, &profile.CreatedAt); err != nil {
+		return err
+	}
+	key, err := openRowKey(keyID, dataKey)
+	if err != nil {
+		return err
+	}
+	profile.NationalID, err = key.open(nationalID)
+	return err
+}
+
+func createApplicantProfileTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS applicant_profiles (
+		profile_id SERIAL PRIMARY KEY,
+		applicant_id INT NOT NULL REFERENCES loan_applicants (applicant_id) ON DELETE CASCADE,
+		version INT NOT NULL,
+		date_of_birth DATE NOT NULL,
+		national_id BYTEA NOT NULL,
+		monthly_income DECIMAL(15, 2) NOT NULL CHECK (monthly_income >= 0),
+		employment_status VARCHAR(15) NOT NULL CHECK (employment_status IN ('employed', 'self_employed', 'unemployed', 'retired', 'student')),
+		employer_name VARCHAR(100) NOT NULL DEFAULT '',
+		employment_months INT NOT NULL DEFAULT 0 CHECK (employment_months >= 0),
+		changed_by VARCHAR(50) NOT NULL DEFAULT '',
+		change_reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (applicant_id, version)
+	)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("error creating applicant_profiles table: %v", err)
+	}
+
+	// National IDs are sealed with a row key, those sealed before directly with the legacy key
+	query = `ALTER TABLE applicant_profiles ADD COLUMN IF NOT EXISTS key_id VARCHAR(64) NOT NULL DEFAULT 'legacy',
+		ADD COLUMN IF NOT EXISTS data_key BYTEA`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("error altering applicant_profiles table: %v", err)
+	}
+	return nil
+}
+
+// validNationalID checks the length and check digit of a Thai national ID number. The check digit is
+// (11 - the sum of the first 12 digits weighted 13 down to 2, mod 11) mod 10.
+func validNationalID(nationalID string) bool {
+	if len(nationalID) != 13 {
+		return false
+	}
+	sum := 0
+	for i, digit := range nationalID {
+		if digit < '0' || digit > '9' {
+			return false
+		}
+		if i < 12 {
+			sum += int(digit-'0') * (13 - i)
+		}
+	}
+	return (11-sum%11)%10 == int(nationalID[12]-'0')
+}
+
+// validateApplicantProfile normalises the national ID of a profile and checks its fields
+func validateApplicantProfile(profile *ApplicantProfile) error {
+	profile.NationalID = strings.NewReplacer("-", "", " ", "").Replace(profile.NationalID)
+
+	dateOfBirth, err := time.Parse("2006-01-02", profile.DateOfBirth)
+	if err != nil {
+		return fmt.Errorf("Invalid DateOfBirth. Expected a date like 1990-01-31")
+	}
+	switch {
+	case dateOfBirth.AddDate(minimumApplicantAge, 0, 0).After(time.Now()):
+		return fmt.Errorf("Applicants must be at least %d years old", minimumApplicantAge)
+	case !validNationalID(profile.NationalID):
+		return fmt.Errorf("Invalid NationalID. Expected a 13-digit Thai national ID number with a valid check digit")
+	case profile.MonthlyIncome.IsNegative():
+		return fmt.Errorf("MonthlyIncome must not be negative")
+	case profile.EmploymentStatus != "employed" && profile.EmploymentStatus != "self_employed" && profile.EmploymentStatus != "unemployed" &&
+		profile.EmploymentStatus != "retired" && profile.EmploymentStatus != "student":
+		return fmt.Errorf("Invalid EmploymentStatus. Allowed values are 'employed', 'self_employed', 'unemployed', 'retired' or 'student'")
+	case profile.EmploymentStatus == "employed" && profile.EmployerName == "":
+		return fmt.Errorf("EmployerName is required for employed applicants")
+	case profile.EmploymentMonths < 0:
+		return fmt.Errorf("EmploymentMonths must not be negative")
+	}
+	return nil
+}
+
+// FindApplicantProfile looks up the current version of an applicant's profile
+func FindApplicantProfile(applicantID int) (ApplicantProfile, error) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return ApplicantProfile{}, err
+	}
+	defer db.Close()
+
+	var profile ApplicantProfile
+	query := "SELECT " + applicantProfileColumns + " FROM applicant_profiles WHERE applicant_id = $1 ORDER BY version DESC LIMIT 1"
+	err = scanApplicantProfile(db.QueryRow(query, applicantID), &profile)
+	return profile, err
+}
+
+// NationalIDs returns the national ID on the current profile of every applicant who has one
+func NationalIDs() (map[int]string, error) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT DISTINCT ON (applicant_id) applicant_id, national_id, key_id, data_key FROM applicant_profiles ORDER BY applicant_id, version DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying national IDs: %v", err)
+	}
+	defer rows.Close()
+
+	nationalIDs := map[int]string{}
+	for rows.Next() {
+		var applicantID int
+		var keyID string
+		var nationalID, dataKey []byte
+		if err := rows.Scan(&applicantID, &nationalID, &keyID, &dataKey); err != nil {
+			return nil, err
+		}
+		key, err := openRowKey(keyID, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		if nationalIDs[applicantID], err = key.open(nationalID); err != nil {
+			return nil, err
+		}
+	}
+	return nationalIDs, rows.Err()
+}
+
+func GetApplicantProfile(w http.ResponseWriter, r *http.Request) {
+	// Get applicant_id from URL parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid applicant ID", http.StatusBadRequest)
+		return
+	}
+
+	profile, err := FindApplicantProfile(id)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "applicant profile not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !PII_Masking.CanUnmask(r) {
+		MaskApplicantProfile(&profile)
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func GetApplicantProfileHistory(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Get applicant_id from URL parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid applicant ID", http.StatusBadRequest)
+		return
+	}
+
+	// Every version of the profile, the latest first
+	rows, err := db.Query("SELECT "+applicantProfileColumns+" FROM applicant_profiles WHERE applicant_id = $1 ORDER BY version DESC", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	unmask := PII_Masking.CanUnmask(r)
+	profiles := []ApplicantProfile{}
+	for rows.Next() {
+		var profile ApplicantProfile
+		if err := scanApplicantProfile(rows, &profile); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !unmask {
+			MaskApplicantProfile(&profile)
+		}
+		profiles = append(profiles, profile)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+}
+
+func UpdateApplicantProfile(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Get applicant_id from URL parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid applicant ID", http.StatusBadRequest)
+		return
+	}
+
+	// Every version of the profile must be traceable to whoever made it
+	changedBy, ok := PII_Masking.CallerName(r)
+	if !ok {
+		errorResponse := map[string]string{"error": "Changing an applicant profile requires a known API token"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Decode JSON request body into an ApplicantProfile struct
+	var profile ApplicantProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	profile.ChangedBy = changedBy
+	if err := validateApplicantProfile(&profile); err != nil {
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+	key, err := newRowKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nationalID, err := key.seal(profile.NationalID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the applicant so that concurrent changes get consecutive versions
+	var applicantStatus string
+	err = tx.QueryRow(`SELECT applicant_id, applicant_status FROM loan_applicants WHERE applicant_id = $1 FOR UPDATE`, id).Scan(&profile.ApplicantID, &applicantStatus)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "applicant not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if applicantStatus == anonymizedStatus {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Applicant %d has been anonymized", id)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Record the profile as its next version, earlier versions are kept as history
+	query := `INSERT INTO applicant_profiles (applicant_id, version, date_of_birth, national_id, key_id, data_key, monthly_income, employment_status,
+			employer_name, employment_months, changed_by, change_reason)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 FROM applicant_profiles WHERE applicant_id = $1
+		RETURNING version`
+	err = tx.QueryRow(query, id, profile.DateOfBirth, nationalID, key.keyID, key.dataKey, profile.MonthlyIncome, profile.EmploymentStatus,
+		profile.EmployerName, profile.EmploymentMonths, profile.ChangedBy, profile.ChangeReason).Scan(&profile.Version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE loan_applicants SET updated_at = CURRENT_TIMESTAMP WHERE applicant_id = $1`, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return success message
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": fmt.Sprintf("Profile of applicant with ID %d updated successfully", id),
+		"version": profile.Version,
+	})
+}
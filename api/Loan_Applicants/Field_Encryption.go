@@ -0,0 +1,491 @@
+package Loan_Applicants
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FieldEncryption configures the envelope encryption of applicants' personal data. Every row is
+// sealed with its own data key, which is kept with the row wrapped by a key-encryption key. Provider
+// 'keyfile' keeps the key-encryption keys in the keyring file, 'kms' leaves them in a KMS speaking the
+// Vault transit API. The keyring file always holds the key of the blind indexes.
+type FieldEncryption struct {
+	Provider          string
+	KeyringFile       string
+	KMS               KMSSettings
+	RotationBatchSize int
+}
+
+// KMSSettings locate the transit key that wraps data keys in the KMS
+type KMSSettings struct {
+	Endpoint string
+	Token    string
+	KeyName  string
+}
+
+// keyring is the JSON keyring file. Keys are the hex-encoded key-encryption keys by ID, new data keys
+// are wrapped by ActiveKeyID. IndexKey must never change, or the blind indexes no longer match.
+type keyring struct {
+	ActiveKeyID string
+	Keys        map[string]string
+	IndexKey    string
+}
+
+// keyProvider wraps and unwraps the data keys of rows with key-encryption keys
+type keyProvider interface {
+	activeKeyID() (string, error)
+	wrap(dataKey []byte) (string, []byte, error)
+	unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Rows sealed before envelope encryption have no data key, their fields are sealed directly with the
+// key-encryption key that used to be kept in keys/pii.key. It is imported into the keyring as 'legacy'.
+const (
+	legacyKeyID   = "legacy"
+	legacyKeyFile = "keys/pii.key"
+)
+
+var (
+	fieldEncryption FieldEncryption
+	provider        keyProvider
+
+	// The keyring as last read and the file it was read from. It is read again when the file has been
+	// replaced, as cmd/rotate_keys does, or a row was sealed under a key it doesn't hold.
+	keyringMu   sync.Mutex
+	fieldKeys   keyring
+	keyringInfo os.FileInfo
+)
+
+// LoadFieldEncryption reads the field encryption settings and keyring, creating the keyring on first
+// start, and connects to the key provider
+func LoadFieldEncryption() error {
+	file, err := os.Open("json/field_encryption.json")
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&fieldEncryption); err != nil {
+		return fmt.Errorf("error decoding JSON: %v", err)
+	}
+	if fieldEncryption.RotationBatchSize <= 0 {
+		return fmt.Errorf("invalid field encryption settings: RotationBatchSize must be positive")
+	}
+
+	ring, info, err := readKeyring(fieldEncryption.KeyringFile)
+	if os.IsNotExist(err) {
+		ring, info, err = createKeyring(fieldEncryption.KeyringFile)
+	}
+	if err != nil {
+		return err
+	}
+	keyringMu.Lock()
+	fieldKeys, keyringInfo = ring, info
+	keyringMu.Unlock()
+
+	switch fieldEncryption.Provider {
+	case "keyfile":
+		provider = keyfileProvider{}
+	case "kms":
+		provider = kmsProvider{settings: fieldEncryption.KMS, client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		return fmt.Errorf("invalid field encryption settings: Provider must be 'keyfile' or 'kms'")
+	}
+	return nil
+}
+
+// readKeyring reads and checks the keyring file. The error satisfies os.IsNotExist if there is none.
+func readKeyring(filename string) (keyring, os.FileInfo, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return keyring{}, nil, err
+	} else if err != nil {
+		return keyring{}, nil, fmt.Errorf("error reading keyring: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return keyring{}, nil, fmt.Errorf("error reading keyring: %v", err)
+	}
+	encoded, err := io.ReadAll(file)
+	if err != nil {
+		return keyring{}, nil, fmt.Errorf("error reading keyring: %v", err)
+	}
+
+	var ring keyring
+	if err := json.Unmarshal(encoded, &ring); err != nil {
+		return keyring{}, nil, fmt.Errorf("error decoding keyring %s: %v", filename, err)
+	}
+	if _, err := decodeKey(ring.IndexKey); err != nil {
+		return keyring{}, nil, fmt.Errorf("invalid keyring %s: IndexKey: %v", filename, err)
+	}
+	for id, key := range ring.Keys {
+		if _, err := decodeKey(key); err != nil {
+			return keyring{}, nil, fmt.Errorf("invalid keyring %s: key %s: %v", filename, id, err)
+		}
+	}
+	return ring, info, nil
+}
+
+// createKeyring generates the keyring on first start, importing the legacy key if there is one. A new
+// keyring can't open rows sealed under the keys of a lost one and its IndexKey matches none of their
+// blind indexes, so it is refused once applicants have been sealed.
+func createKeyring(filename string) (keyring, os.FileInfo, error) {
+	sealed, err := sealedApplicantsExist()
+	if err != nil {
+		return keyring{}, nil, err
+	}
+	if sealed {
+		return keyring{}, nil, fmt.Errorf("keyring %s is missing but loan_applicants holds rows sealed under it, restore the keyring file", filename)
+	}
+
+	ring := keyring{Keys: map[string]string{}, IndexKey: newKeyHex()}
+	ring.ActiveKeyID = newKeyID()
+	ring.Keys[ring.ActiveKeyID] = newKeyHex()
+	if legacy, err := os.ReadFile(legacyKeyFile); err == nil {
+		ring.Keys[legacyKeyID] = strings.TrimSpace(string(legacy))
+	}
+	if err := writeKeyring(filename, ring); err != nil {
+		return keyring{}, nil, err
+	}
+	log.Printf("Generated a new field encryption keyring in %s", filename)
+	return readKeyring(filename)
+}
+
+// sealedApplicantsExist reports whether loan_applicants holds rows sealed under a key of the keyring.
+// Before the first start there is no table, and a table from before encryption has no key_id column.
+func sealedApplicantsExist() (bool, error) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var encrypted bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'loan_applicants' AND column_name = 'key_id')`).Scan(&encrypted)
+	if err != nil || !encrypted {
+		return false, err
+	}
+	var sealed bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM loan_applicants WHERE key_id IS NOT NULL)`).Scan(&sealed)
+	if err != nil {
+		return false, fmt.Errorf("error inspecting loan_applicants table: %v", err)
+	}
+	return sealed, nil
+}
+
+// currentKeyring returns the keyring, read again first if the keyring file has been replaced since it
+// was last read. Files are replaced by a rename, so a new file is told apart from the old one even if
+// it was written within the same second.
+func currentKeyring() (keyring, error) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	info, err := os.Stat(fieldEncryption.KeyringFile)
+	if err != nil {
+		return keyring{}, fmt.Errorf("error reading keyring: %v", err)
+	}
+	if keyringInfo != nil && os.SameFile(info, keyringInfo) && info.ModTime().Equal(keyringInfo.ModTime()) {
+		return fieldKeys, nil
+	}
+	return reloadKeyring()
+}
+
+// reloadKeyring reads the keyring file again, keyringMu must be held. The IndexKey must be the one the
+// blind indexes were made with.
+func reloadKeyring() (keyring, error) {
+	ring, info, err := readKeyring(fieldEncryption.KeyringFile)
+	if err != nil {
+		return keyring{}, err
+	}
+	if ring.IndexKey != fieldKeys.IndexKey {
+		return keyring{}, fmt.Errorf("invalid keyring %s: IndexKey has changed, the blind indexes would no longer match", fieldEncryption.KeyringFile)
+	}
+	if ring.ActiveKeyID != fieldKeys.ActiveKeyID {
+		log.Printf("Field encryption key %s is now active", ring.ActiveKeyID)
+	}
+	fieldKeys, keyringInfo = ring, info
+	return ring, nil
+}
+
+// keyringKey returns a key-encryption key of the keyring by ID. A key that isn't in the keyring may have
+// been added since it was read, so the file is read again before giving up.
+func keyringKey(keyID string) ([]byte, error) {
+	ring, err := currentKeyring()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := ring.Keys[keyID]
+	if !ok {
+		keyringMu.Lock()
+		ring, err = reloadKeyring()
+		keyringMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if key, ok = ring.Keys[keyID]; !ok {
+			return nil, fmt.Errorf("key %s is not in the keyring", keyID)
+		}
+	}
+	return decodeKey(key)
+}
+
+// writeKeyring replaces the keyring file, through a temporary file so that it is never left half written
+func writeKeyring(filename string, ring keyring) error {
+	encoded, err := json.MarshalIndent(ring, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return fmt.Errorf("error creating keyring directory: %v", err)
+	}
+	if err := os.WriteFile(filename+".tmp", encoded, 0o600); err != nil {
+		return fmt.Errorf("error writing keyring: %v", err)
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func newKeyHex() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+// newKeyID names a new key-encryption key by when it was made, with a random suffix so that keys made
+// within the same second get different IDs
+func newKeyID() string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		panic(err)
+	}
+	return "k" + time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("expected a hex-encoded 256-bit key")
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts with AES-GCM, the random nonce is kept in front of the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+}
+
+// blindIndex is a keyed hash of a value, so that rows can be looked up and kept unique by the value
+// without storing it in plaintext. Values are compared trimmed and case-insensitively.
+func blindIndex(value string) []byte {
+	keyringMu.Lock()
+	key, _ := decodeKey(fieldKeys.IndexKey)
+	keyringMu.Unlock()
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(value))))
+	return mac.Sum(nil)
+}
+
+// rowKey is the data key the fields of one row are sealed with, and the wrapped form kept with the row
+type rowKey struct {
+	keyID   string
+	dataKey []byte
+	aead    cipher.AEAD
+}
+
+// newRowKey generates a data key for a row, wrapped by the active key-encryption key
+func newRowKey() (rowKey, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return rowKey{}, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return rowKey{}, err
+	}
+	keyID, wrapped, err := provider.wrap(dataKey)
+	if err != nil {
+		return rowKey{}, fmt.Errorf("error wrapping data key: %v", err)
+	}
+	return rowKey{keyID: keyID, dataKey: wrapped, aead: aead}, nil
+}
+
+// openRowKey unwraps the data key kept with a row. A row without one was sealed with the legacy key.
+func openRowKey(keyID string, wrapped []byte) (rowKey, error) {
+	if wrapped == nil {
+		key, err := keyringKey(keyID)
+		if err != nil {
+			return rowKey{}, err
+		}
+		aead, err := newAEAD(key)
+		return rowKey{keyID: keyID, aead: aead}, err
+	}
+
+	dataKey, err := provider.unwrap(keyID, wrapped)
+	if err != nil {
+		return rowKey{}, fmt.Errorf("error unwrapping data key: %v", err)
+	}
+	aead, err := newAEAD(dataKey)
+	return rowKey{keyID: keyID, dataKey: wrapped, aead: aead}, err
+}
+
+func (k rowKey) seal(plaintext string) ([]byte, error) {
+	return seal(k.aead, []byte(plaintext), nil)
+}
+
+func (k rowKey) open(ciphertext []byte) (string, error) {
+	plaintext, err := open(k.aead, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting field: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// keyfileProvider wraps data keys with the key-encryption keys of the keyring file
+type keyfileProvider struct{}
+
+func (keyfileProvider) activeKeyID() (string, error) {
+	ring, err := currentKeyring()
+	return ring.ActiveKeyID, err
+}
+
+// wrap wraps a data key with the key active in the keyring file as it is now, so that rows are sealed
+// under a new key as soon as it is made active
+func (keyfileProvider) wrap(dataKey []byte) (string, []byte, error) {
+	ring, err := currentKeyring()
+	if err != nil {
+		return "", nil, err
+	}
+	keyID := ring.ActiveKeyID
+	key, err := decodeKey(ring.Keys[keyID])
+	if err != nil {
+		return "", nil, fmt.Errorf("active key %s: %v", keyID, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", nil, err
+	}
+	wrapped, err := seal(aead, dataKey, []byte(keyID))
+	return keyID, wrapped, err
+}
+
+func (keyfileProvider) unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	key, err := keyringKey(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %v", keyID, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, wrapped, []byte(keyID))
+}
+
+// kmsProvider wraps data keys with a transit key of the KMS, which never hands out the key itself.
+// Key IDs are the key name and version, as in 'lms-pii:v2'.
+type kmsProvider struct {
+	settings KMSSettings
+	client   *http.Client
+}
+
+// call posts a request to the transit API and decodes the data of its response
+func (p kmsProvider) call(method string, path string, body interface{}, data interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequest(method, strings.TrimRight(p.settings.Endpoint, "/")+"/v1/transit/"+path, &payload)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Vault-Token", p.settings.Token)
+	response, err := p.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error calling the KMS: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("the KMS answered %s", response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(&struct{ Data interface{} }{Data: data})
+}
+
+func (p kmsProvider) activeKeyID() (string, error) {
+	var key struct {
+		LatestVersion int `json:"latest_version"`
+	}
+	if err := p.call(http.MethodGet, "keys/"+p.settings.KeyName, nil, &key); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:v%d", p.settings.KeyName, key.LatestVersion), nil
+}
+
+func (p kmsProvider) wrap(dataKey []byte) (string, []byte, error) {
+	var encrypted struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	body := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}
+	if err := p.call(http.MethodPost, "encrypt/"+p.settings.KeyName, body, &encrypted); err != nil {
+		return "", nil, err
+	}
+
+	// Transit ciphertexts read 'vault:v<version>:<ciphertext>'
+	parts := strings.SplitN(encrypted.Ciphertext, ":", 3)
+	if len(parts) != 3 {
+		return "", nil, fmt.Errorf("unexpected ciphertext from the KMS")
+	}
+	return p.settings.KeyName + ":" + parts[1], []byte(encrypted.Ciphertext), nil
+}
+
+func (p kmsProvider) unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	if !strings.HasPrefix(keyID, p.settings.KeyName+":") {
+		return nil, fmt.Errorf("key %s is not the transit key %s", keyID, p.settings.KeyName)
+	}
+	var decrypted struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := p.call(http.MethodPost, "decrypt/"+p.settings.KeyName, map[string]string{"ciphertext": string(wrapped)}, &decrypted); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(decrypted.Plaintext)
+}
@@ -3,12 +3,14 @@ package Loan_Applicants
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 
+	"github.com/SupachotT/Loan_Management_System.git/api/PII_Masking"
 	"github.com/gorilla/mux"
 	"github.com/lib/pq"
 )
@@ -45,11 +47,30 @@ func SetupDatabase() {
 	}
 	defer db.Close()
 
+	// Load the keys personal data is encrypted with
+	if err := LoadFieldEncryption(); err != nil {
+		log.Fatal(err)
+	}
+
 	// Create the loan_applicants table if it doesn't exist
 	if err := createLoanApplicantTable(db); err != nil {
 		log.Fatal("Error creating loan_applicants table:", err)
 	}
 
+	// Create the versioned applicant profiles, whose national IDs are encrypted
+	if err := createApplicantProfileTable(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the history of consents and read what applicants are asked to consent to
+	if err := createApplicantConsentTable(db); err != nil {
+		log.Fatal(err)
+	}
+	consentPolicy, err = readConsentPolicyFromFile("json/consent_texts.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Read data from JSON file
 	loan_applicant, err := readCustomersFromFile("json/Applicants.json")
 	if err != nil {
@@ -59,7 +80,7 @@ func SetupDatabase() {
 	// Insert each applicants into the database
 	for _, loan_applicant := range loan_applicant {
 		pk := InsertLoanApplicant(db, loan_applicant)
-		fmt.Printf("Inserted loan applicant ID = %d\n", pk)
+		log.Printf("Inserted loan applicant ID = %d", pk)
 	}
 }
 
@@ -68,10 +89,13 @@ func createLoanApplicantTable(db *sql.DB) error {
 		applicant_id SERIAL PRIMARY KEY,
 		first_name VARCHAR(50) NOT NULL,
 		last_name VARCHAR(50) NOT NULL,
-		address VARCHAR(100) NOT NULL,
-		phone VARCHAR(15) NOT NULL,
-		email VARCHAR(100) NOT NULL UNIQUE,
-		applicant_status VARCHAR(15) NOT NULL CHECK (applicant_status IN ('newBorrower', 'currentBorrower')),
+		address BYTEA NOT NULL,
+		phone BYTEA NOT NULL,
+		email BYTEA NOT NULL,
+		email_index BYTEA,
+		key_id VARCHAR(64) NOT NULL,
+		data_key BYTEA,
+		applicant_status VARCHAR(15) NOT NULL,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	)`
@@ -80,21 +104,191 @@ func createLoanApplicantTable(db *sql.DB) error {
 	if err != nil {
 		return fmt.Errorf("error creating loan_applicants table: %v", err)
 	}
+
+	// Encrypt the personal data of a table created before it was, then keep emails unique through
+	// their blind index
+	if err := migratePlaintextPII(db); err != nil {
+		return err
+	}
+
+	// Anonymized applicants keep no email, and so no blind index
+	queries := []string{
+		`ALTER TABLE loan_applicants ALTER COLUMN email_index DROP NOT NULL`,
+		// Applicant statuses allowed, replaced whenever a new status is introduced
+		`ALTER TABLE loan_applicants DROP CONSTRAINT IF EXISTS loan_applicants_applicant_status_check`,
+		`ALTER TABLE loan_applicants ADD CONSTRAINT loan_applicants_applicant_status_check CHECK (applicant_status IN ('newBorrower', 'currentBorrower', 'anonymized'))`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("error altering loan_applicants table: %v", err)
+		}
+	}
+	query = `CREATE UNIQUE INDEX IF NOT EXISTS loan_applicants_email_index ON loan_applicants (email_index)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("error creating loan_applicants email index: %v", err)
+	}
 	return nil
 }
 
 func InsertLoanApplicant(db *sql.DB, applicant Loan_applicants) int {
-	query := `INSERT INTO loan_applicants (first_name, last_name, address, phone, email, applicant_status)
-		VALUES ($1, $2, $3, $4, $5, $6) RETURNING applicant_id`
+	sealed, err := sealApplicant(applicant)
+	if err != nil {
+		log.Fatal(err)
+	}
+	query := `INSERT INTO loan_applicants (first_name, last_name, applicant_status, address, phone, email, email_index, key_id, data_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING applicant_id`
 
 	var pk int
-	err := db.QueryRow(query, applicant.First_name, applicant.Last_name, applicant.Address, applicant.Phone, applicant.Email, applicant.Applicant_Status).Scan(&pk)
+	err = db.QueryRow(query, append([]interface{}{applicant.First_name, applicant.Last_name, applicant.Applicant_Status}, sealed...)...).Scan(&pk)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return pk
 }
 
+// FindApplicant looks up a loan applicant by ID
+func FindApplicant(id int) (Loan_applicants, error) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return Loan_applicants{}, err
+	}
+	defer db.Close()
+
+	var applicant Loan_applicants
+	err = scanApplicant(db.QueryRow("SELECT "+applicantColumns+" FROM loan_applicants WHERE applicant_id = $1", id), &applicant)
+	return applicant, err
+}
+
+// FindApplicantByEmail looks up a loan applicant by email through its blind index
+func FindApplicantByEmail(email string) (Loan_applicants, error) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return Loan_applicants{}, err
+	}
+	defer db.Close()
+
+	var applicant Loan_applicants
+	err = scanApplicant(db.QueryRow("SELECT "+applicantColumns+" FROM loan_applicants WHERE email_index = $1", blindIndex(email)), &applicant)
+	return applicant, err
+}
+
+// MarkCurrentBorrower moves a new borrower to 'currentBorrower' once a loan has been granted to them
+func MarkCurrentBorrower(id int) error {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	query := `UPDATE loan_applicants SET applicant_status = 'currentBorrower', updated_at = CURRENT_TIMESTAMP WHERE applicant_id = $1 AND applicant_status = 'newBorrower'`
+	if _, err := db.Exec(query, id); err != nil {
+		return fmt.Errorf("error updating applicant status: %v", err)
+	}
+	return nil
+}
+
+// ListApplicants returns every loan applicant who hasn't been anonymized
+func ListApplicants() ([]Loan_applicants, error) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT "+applicantColumns+" FROM loan_applicants WHERE applicant_status <> $1 ORDER BY applicant_id", anonymizedStatus)
+	if err != nil {
+		return nil, fmt.Errorf("error querying loan applicants: %v", err)
+	}
+	defer rows.Close()
+
+	var applicants []Loan_applicants
+	for rows.Next() {
+		var applicant Loan_applicants
+		if err := scanApplicant(rows, &applicant); err != nil {
+			return nil, err
+		}
+		applicants = append(applicants, applicant)
+	}
+	return applicants, rows.Err()
+}
+
+// MergeApplicant folds an applicant found to be a duplicate into the applicant who stays on record and
+// deletes the duplicate. The duplicate's profile versions are kept as the earliest of the survivor's
+// history, so the survivor's own profile stays current. The survivor takes over the duplicate's
+// consents so that the latest choice of either holds, and becomes a current borrower if the duplicate
+// was one. Everything other packages hold about the duplicate must be reassigned before. It returns
+// how many profile versions were moved over, or sql.ErrNoRows if the survivor doesn't exist.
+func MergeApplicant(fromID int, toID int) (int64, error) {
+	db, err := connectLMS_LoanApplicantsDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT applicant_id, applicant_status FROM loan_applicants WHERE applicant_id IN ($1, $2) ORDER BY applicant_id FOR UPDATE`, fromID, toID)
+	if err != nil {
+		return 0, err
+	}
+	statuses := map[int]string{}
+	for rows.Next() {
+		var id int
+		var status string
+		if err := rows.Scan(&id, &status); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		statuses[id] = status
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if _, ok := statuses[toID]; !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	// Make room for the duplicate's profile versions in front of the survivor's, going through negative
+	// versions as the versions of an applicant are unique at every row
+	var profiles int64
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM applicant_profiles WHERE applicant_id = $1`, fromID).Scan(&profiles); err != nil {
+		return 0, err
+	}
+	moves := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE applicant_profiles SET version = -version WHERE applicant_id = $1`, []interface{}{toID}},
+		{`UPDATE applicant_profiles SET version = -version + $2 WHERE applicant_id = $1`, []interface{}{toID, profiles}},
+		{`UPDATE applicant_profiles SET applicant_id = $2, version = moved.version FROM (
+			SELECT profile_id, ROW_NUMBER() OVER (ORDER BY version) AS version FROM applicant_profiles WHERE applicant_id = $1
+		) moved WHERE applicant_profiles.profile_id = moved.profile_id`, []interface{}{fromID, toID}},
+	}
+	for _, move := range moves {
+		if _, err := tx.Exec(move.query, move.args...); err != nil {
+			return 0, fmt.Errorf("error moving the profile of applicant %d to %d: %v", fromID, toID, err)
+		}
+	}
+
+	queries := []string{
+		`UPDATE applicant_consents SET applicant_id = $2 WHERE applicant_id = $1`,
+		`UPDATE loan_applicants SET applicant_status = 'currentBorrower', updated_at = CURRENT_TIMESTAMP
+			WHERE applicant_id = $2 AND EXISTS (SELECT 1 FROM loan_applicants WHERE applicant_id = $1 AND applicant_status = 'currentBorrower')`,
+		`DELETE FROM loan_applicants WHERE applicant_id = $1`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, fromID, toID); err != nil {
+			return 0, fmt.Errorf("error merging applicant %d into %d: %v", fromID, toID, err)
+		}
+	}
+	return profiles, tx.Commit()
+}
+
 func readCustomersFromFile(filename string) ([]Loan_applicants, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -119,21 +313,32 @@ func GetApplicants(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	// Query from the loan_applicants table
-	rows, err := db.Query("SELECT applicant_id, first_name, last_name, address, phone, email, applicant_status, created_at, updated_at FROM loan_applicants")
+	// Query from the loan_applicants table, optionally for one email only through its blind index
+	query := "SELECT " + applicantColumns + " FROM loan_applicants"
+	var args []interface{}
+	if email := r.URL.Query().Get("email"); email != "" {
+		query += " WHERE email_index = $1"
+		args = append(args, blindIndex(email))
+	}
+	rows, err := db.Query(query+" ORDER BY applicant_id", args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
+	unmask := PII_Masking.CanUnmask(r)
+
 	var loanApplicants []Loan_applicants
 	for rows.Next() {
 		var loanApplicant Loan_applicants
-		if err := rows.Scan(&loanApplicant.Applicant_id, &loanApplicant.First_name, &loanApplicant.Last_name, &loanApplicant.Address, &loanApplicant.Phone, &loanApplicant.Email, &loanApplicant.Applicant_Status, &loanApplicant.Created_at, &loanApplicant.Updated_at); err != nil {
+		if err := scanApplicant(rows, &loanApplicant); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if !unmask {
+			MaskApplicant(&loanApplicant)
+		}
 		loanApplicants = append(loanApplicants, loanApplicant)
 	}
 	if err := rows.Err(); err != nil {
@@ -164,8 +369,7 @@ func GetApplicantByID(w http.ResponseWriter, r *http.Request) {
 
 	// Query database for Loan_applicants with given applicant_id
 	var loanApplicant Loan_applicants
-	query := `SELECT applicant_id, first_name, last_name, address, phone, email, applicant_status, created_at, updated_at FROM loan_applicants WHERE applicant_id = $1`
-	err = db.QueryRow(query, id).Scan(&loanApplicant.Applicant_id, &loanApplicant.First_name, &loanApplicant.Last_name, &loanApplicant.Address, &loanApplicant.Phone, &loanApplicant.Email, &loanApplicant.Applicant_Status, &loanApplicant.Created_at, &loanApplicant.Updated_at)
+	err = scanApplicant(db.QueryRow("SELECT "+applicantColumns+" FROM loan_applicants WHERE applicant_id = $1", id), &loanApplicant)
 	if err == sql.ErrNoRows {
 		// Return JSON error response if no customer with the given ID exists
 		errorResponse := map[string]string{"error": "applicant not found"}
@@ -177,6 +381,9 @@ func GetApplicantByID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !PII_Masking.CanUnmask(r) {
+		MaskApplicant(&loanApplicant)
+	}
 
 	// Return JSON response
 	w.Header().Set("Content-Type", "application/json")
@@ -199,10 +406,27 @@ func CreateApplicants(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Validate applicant_status, applicants are only anonymized through an erasure request
+	if newApplicant.Applicant_Status != "newBorrower" && newApplicant.Applicant_Status != "currentBorrower" {
+		errorResponse := map[string]string{"error": "Invalid applicant status. Allowed values are 'newBorrower' or 'currentBorrower'"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Seal the personal data of the applicant
+	sealed, err := sealApplicant(newApplicant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Insert query
-	query := `INSERT INTO loan_applicants (first_name, last_name, address, phone, email, applicant_status) VALUES ($1, $2, $3, $4, $5, $6) RETURNING applicant_id`
+	query := `INSERT INTO loan_applicants (first_name, last_name, applicant_status, address, phone, email, email_index, key_id, data_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING applicant_id`
 	var newApplicantID int
-	err = db.QueryRow(query, newApplicant.First_name, newApplicant.Last_name, newApplicant.Address, newApplicant.Phone, newApplicant.Email, newApplicant.Applicant_Status).Scan(&newApplicantID)
+	err = db.QueryRow(query, append([]interface{}{newApplicant.First_name, newApplicant.Last_name, newApplicant.Applicant_Status}, sealed...)...).Scan(&newApplicantID)
 	if err != nil {
 		pgErr, ok := err.(*pq.Error)
 		if ok && pgErr.Code.Name() == "unique_violation" {
@@ -268,9 +492,18 @@ func UpdateApplicants(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Seal the personal data of the applicant under a new row key
+	sealed, err := sealApplicant(updateApplicant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Update query
-	query := `UPDATE loan_applicants SET first_name = $2, last_name = $3, address = $4, phone = $5, email = $6, applicant_status = $7 WHERE applicant_id = $1`
-	result, err := db.Exec(query, id, updateApplicant.First_name, updateApplicant.Last_name, updateApplicant.Address, updateApplicant.Phone, updateApplicant.Email, updateApplicant.Applicant_Status)
+	// Anonymized applicants aren't given personal data again
+	query := `UPDATE loan_applicants SET first_name = $2, last_name = $3, applicant_status = $4, address = $5, phone = $6, email = $7,
+		email_index = $8, key_id = $9, data_key = $10 WHERE applicant_id = $1 AND applicant_status <> 'anonymized'`
+	result, err := db.Exec(query, append([]interface{}{id, updateApplicant.First_name, updateApplicant.Last_name, updateApplicant.Applicant_Status}, sealed...)...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -279,6 +512,19 @@ func UpdateApplicants(w http.ResponseWriter, r *http.Request) {
 	// Check if any rows were affected
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
+		anonymized, err := isAnonymized(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if anonymized {
+			errorResponse := map[string]string{"error": fmt.Sprintf("Applicant %d has been anonymized", id)}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(errorResponse)
+			return
+		}
+
 		// Return JSON error response if no applicant with the given ID was found to update
 		errorResponse := map[string]string{"error": "Applicant ID not found or no update performed"}
 		w.Header().Set("Content-Type", "application/json")
@@ -310,6 +556,18 @@ func DeleteApplicants(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Applicants with anything still held about them can only be anonymized
+	if err := runDeleteHooks(id); errors.Is(err, ErrApplicantReferenced) {
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Delete query
 	query := `DELETE FROM loan_applicants WHERE applicant_id = $1`
 	result, err := db.Exec(query, id)
@@ -0,0 +1,268 @@
+package Loan_Applications
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Applicants"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Payments"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Products"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+	"gopkg.in/yaml.v3"
+)
+
+// CreditRule is one limit an application is checked against. Type names the measure of the applicant
+// it limits and Action is what happens to the application when the limit is broken, 'decline' or
+// 'refer' to a loan officer.
+type CreditRule struct {
+	Name   string          `yaml:"name"`
+	Type   string          `yaml:"type"`
+	Limit  decimal.Decimal `yaml:"limit"`
+	Action string          `yaml:"action"`
+}
+
+// CreditMetrics are the measures of an applicant the credit rules are checked against. MonthlyDebt is
+// what the applicant would repay a month on existing loans and the loan applied for.
+type CreditMetrics struct {
+	MonthlyDebt      decimal.Decimal
+	DeclaredIncome   decimal.Decimal
+	DebtToIncome     decimal.Decimal
+	Exposure         decimal.Decimal
+	MaxDaysPastDue   int
+	RelationshipDays int
+}
+
+// FiredRule is a credit rule an application broke, with the applicant's Value it was broken by
+type FiredRule struct {
+	Name    string
+	Type    string
+	Action  string
+	Limit   decimal.Decimal
+	Value   decimal.Decimal
+	Message string
+}
+
+// CreditDecision is the outcome of running the credit rules on an application: 'decline' when a
+// decline rule fired, 'refer' when only refer rules fired and 'approve' when none did
+type CreditDecision struct {
+	ApplicationID int
+	Decision      string
+	FiredRules    []FiredRule
+	Metrics       CreditMetrics
+	EvaluatedAt   Loan_Submits.CustomDate
+}
+
+var creditRules []CreditRule
+
+// The measure each rule type limits, and whether it limits it from above or from below
+var creditRuleTypes = map[string]struct {
+	measure func(CreditMetrics) decimal.Decimal
+	minimum bool
+}{
+	"max_debt_to_income":    {func(m CreditMetrics) decimal.Decimal { return m.DebtToIncome }, false},
+	"max_exposure":          {func(m CreditMetrics) decimal.Decimal { return m.Exposure }, false},
+	"max_days_past_due":     {func(m CreditMetrics) decimal.Decimal { return decimal.NewFromInt(int64(m.MaxDaysPastDue)) }, false},
+	"min_relationship_days": {func(m CreditMetrics) decimal.Decimal { return decimal.NewFromInt(int64(m.RelationshipDays)) }, true},
+}
+
+func readCreditRulesFromFile(filename string) ([]CreditRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var config struct {
+		Rules []CreditRule `yaml:"rules"`
+	}
+	if err := yaml.NewDecoder(file).Decode(&config); err != nil {
+		return nil, fmt.Errorf("error decoding YAML: %v", err)
+	}
+	for _, rule := range config.Rules {
+		if _, ok := creditRuleTypes[rule.Type]; !ok {
+			return nil, fmt.Errorf("invalid credit rule %q: unknown type %q", rule.Name, rule.Type)
+		}
+		if rule.Action != "decline" && rule.Action != "refer" {
+			return nil, fmt.Errorf("invalid credit rule %q: action must be 'decline' or 'refer'", rule.Name)
+		}
+		if rule.Limit.IsNegative() {
+			return nil, fmt.Errorf("invalid credit rule %q: limit must not be negative", rule.Name)
+		}
+	}
+	return config.Rules, nil
+}
+
+// applyCreditRules checks the metrics of an applicant against every credit rule
+func applyCreditRules(rules []CreditRule, metrics CreditMetrics) (string, []FiredRule) {
+	decision := "approve"
+	var fired []FiredRule
+	for _, rule := range rules {
+		ruleType := creditRuleTypes[rule.Type]
+		value := ruleType.measure(metrics)
+		var message string
+		switch {
+		case rule.Type == "max_debt_to_income" && !metrics.DeclaredIncome.IsPositive() && metrics.MonthlyDebt.IsPositive():
+			message = "no income declared to repay the loan from"
+		case ruleType.minimum && value.LessThan(rule.Limit):
+			message = fmt.Sprintf("%s is below the minimum of %s", value, rule.Limit)
+		case !ruleType.minimum && value.GreaterThan(rule.Limit):
+			message = fmt.Sprintf("%s is above the maximum of %s", value, rule.Limit)
+		default:
+			continue
+		}
+
+		fired = append(fired, FiredRule{Name: rule.Name, Type: rule.Type, Action: rule.Action, Limit: rule.Limit, Value: value, Message: message})
+		if rule.Action == "decline" {
+			decision = "decline"
+		} else if decision == "approve" {
+			decision = "refer"
+		}
+	}
+	return decision, fired
+}
+
+// creditMetrics measures the applicant of an application as of the given date from their loan submits
+// and the payments made on them
+func creditMetrics(application LoanApplication, asOf time.Time) (CreditMetrics, error) {
+	metrics := CreditMetrics{DeclaredIncome: application.DeclaredIncome, Exposure: application.RequestedAmount}
+
+	applicant, err := Loan_Applicants.FindApplicant(application.ApplicantID)
+	if err != nil {
+		return CreditMetrics{}, fmt.Errorf("error finding applicant %d: %v", application.ApplicantID, err)
+	}
+	registered, err := time.Parse(time.RFC3339Nano, applicant.Created_at)
+	if err != nil {
+		return CreditMetrics{}, fmt.Errorf("error parsing created_at of applicant %d: %v", application.ApplicantID, err)
+	}
+	if days := int(asOf.Sub(truncateToDay(registered)).Hours() / 24); days > 0 {
+		metrics.RelationshipDays = days
+	}
+
+	// The loan applied for is costed at the highest rate of its product, as the rate isn't set until approval
+	product, err := Loan_Products.FindLoanProduct(application.ProductID)
+	if err != nil {
+		return CreditMetrics{}, fmt.Errorf("error finding loan product %d: %v", application.ProductID, err)
+	}
+	dueDates, err := product.DueDates(asOf, Loan_Products.AddMonths(asOf, application.TermMonths))
+	if err != nil {
+		return CreditMetrics{}, err
+	}
+	for _, installment := range Loan_Submits.GenerateInstallments(application.RequestedAmount, product.MaxInterestRate, asOf, dueDates, 1) {
+		metrics.MonthlyDebt = metrics.MonthlyDebt.Add(installment.PrincipalDue).Add(installment.InterestDue)
+	}
+	metrics.MonthlyDebt = metrics.MonthlyDebt.Div(decimal.NewFromInt(int64(application.TermMonths)))
+
+	// The exposure includes the loans the applicant is a co-borrower or guarantor of
+	exposure, err := Loan_Submits.ApplicantExposure(application.ApplicantID)
+	if err != nil {
+		return CreditMetrics{}, err
+	}
+	metrics.Exposure = metrics.Exposure.Add(exposure.OutstandingPrincipal)
+
+	loanSubmits, err := Loan_Submits.ListLoanSubmits("")
+	if err != nil {
+		return CreditMetrics{}, err
+	}
+	for _, loanSubmit := range loanSubmits {
+		if loanSubmit.ApplicantID != application.ApplicantID {
+			continue
+		}
+
+		days, err := maxDaysPastDue(loanSubmit, asOf)
+		if err != nil {
+			return CreditMetrics{}, fmt.Errorf("error evaluating loan submit %d: %v", loanSubmit.LoanSubmitID, err)
+		}
+		if days > metrics.MaxDaysPastDue {
+			metrics.MaxDaysPastDue = days
+		}
+		if loanSubmit.LoanStatus != "ongoing" {
+			continue
+		}
+
+		// An ongoing loan adds the installments due over the next month
+		_, versions, err := Loan_Submits.GetLoanSchedule(loanSubmit.LoanSubmitID)
+		if err != nil {
+			return CreditMetrics{}, err
+		}
+		monthEnd := asOf.AddDate(0, 1, 0)
+		for _, installment := range Loan_Submits.CurrentInstallments(versions) {
+			if installment.DueDate.After(asOf) && !installment.DueDate.After(monthEnd) {
+				metrics.MonthlyDebt = metrics.MonthlyDebt.Add(installment.PrincipalDue).Add(installment.InterestDue)
+			}
+		}
+	}
+
+	metrics.MonthlyDebt = metrics.MonthlyDebt.Round(2)
+	if metrics.DeclaredIncome.IsPositive() {
+		metrics.DebtToIncome = metrics.MonthlyDebt.Div(metrics.DeclaredIncome).Round(4)
+	}
+	return metrics, nil
+}
+
+// maxDaysPastDue returns the most days any installment of a loan submit went unpaid after falling due
+func maxDaysPastDue(loanSubmit Loan_Submits.LoanSubmit, asOf time.Time) (int, error) {
+	history, err := Loan_Payments.RepaymentHistory(loanSubmit, asOf)
+	if err != nil {
+		return 0, err
+	}
+	days := 0
+	for _, installment := range history {
+		if installment.DaysLate > days {
+			days = installment.DaysLate
+		}
+	}
+	return days, nil
+}
+
+// EvaluateLoanApplication runs the credit rules on an application as it stands today. The decision
+// is a recommendation for the loan officer, it doesn't move the application.
+func EvaluateLoanApplication(w http.ResponseWriter, r *http.Request) {
+	// Extract application_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Application ID", http.StatusBadRequest)
+		return
+	}
+
+	application, err := FindLoanApplication(id)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan application not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	asOf := truncateToDay(time.Now())
+	metrics, err := creditMetrics(application, asOf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	decision, fired := applyCreditRules(creditRules, metrics)
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CreditDecision{
+		ApplicationID: id,
+		Decision:      decision,
+		FiredRules:    fired,
+		Metrics:       metrics,
+		EvaluatedAt:   Loan_Submits.CustomDate{Time: asOf},
+	})
+}
+
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,251 @@
+package Loan_Collections
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+)
+
+// ContactAttempt is a call, message or visit made to the borrower of a collection case
+type ContactAttempt struct {
+	ContactID   int
+	CaseID      int
+	ContactDate Loan_Submits.CustomDate
+	Channel     string
+	Outcome     string
+	Collector   string
+	Notes       string
+	CreatedAt   string
+}
+
+// PromiseToPay is the borrower's commitment to pay PromisedAmount by PromisedDate. It is 'kept' once
+// payments received from PromiseMadeDate add up to the amount, and 'broken' if they don't by the date.
+type PromiseToPay struct {
+	PromiseID       int
+	CaseID          int
+	PromisedAmount  decimal.Decimal
+	PromisedDate    Loan_Submits.CustomDate
+	PromiseMadeDate Loan_Submits.CustomDate
+	PromiseStatus   string
+	PaidAmount      decimal.Decimal
+	CreatedAt       string
+}
+
+// Columns selected into a PromiseToPay by scanPromise
+const promiseColumns = "promise_id, case_id, promised_amount, promised_date, promise_made_date, promise_status, paid_amount, created_at"
+
+func scanPromise(row interface{ Scan(...interface{}) error }, promise *PromiseToPay) error {
+	return row.Scan(&promise.PromiseID, &promise.CaseID, &promise.PromisedAmount, &promise.PromisedDate, &promise.PromiseMadeDate,
+		&promise.PromiseStatus, &promise.PaidAmount, &promise.CreatedAt)
+}
+
+func loadContactAttempts(db *sql.DB, caseID int) ([]ContactAttempt, error) {
+	rows, err := db.Query(`SELECT contact_id, case_id, contact_date, channel, outcome, collector, notes, created_at
+		FROM contact_attempts WHERE case_id = $1 ORDER BY contact_date, contact_id`, caseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contacts []ContactAttempt
+	for rows.Next() {
+		var contact ContactAttempt
+		if err := rows.Scan(&contact.ContactID, &contact.CaseID, &contact.ContactDate, &contact.Channel, &contact.Outcome,
+			&contact.Collector, &contact.Notes, &contact.CreatedAt); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
+
+func loadPromises(db *sql.DB, caseID int) ([]PromiseToPay, error) {
+	rows, err := db.Query("SELECT "+promiseColumns+" FROM promises_to_pay WHERE case_id = $1 ORDER BY promise_made_date, promise_id", caseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var promises []PromiseToPay
+	for rows.Next() {
+		var promise PromiseToPay
+		if err := scanPromise(rows, &promise); err != nil {
+			return nil, err
+		}
+		promises = append(promises, promise)
+	}
+	return promises, rows.Err()
+}
+
+// findOpenCase looks up a collection case that is still being worked, writing the error response if
+// there is none
+func findOpenCase(w http.ResponseWriter, db *sql.DB, r *http.Request) (CollectionCase, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Case ID", http.StatusBadRequest)
+		return CollectionCase{}, false
+	}
+
+	collectionCase, err := findCollectionCase(db, id)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "collection case not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return CollectionCase{}, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return CollectionCase{}, false
+	}
+	if collectionCase.CaseStatus == "closed" {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Collection case %d is closed", id)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errorResponse)
+		return CollectionCase{}, false
+	}
+	return collectionCase, true
+}
+
+func CreateContactAttempt(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLoanCollectionsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	collectionCase, ok := findOpenCase(w, db, r)
+	if !ok {
+		return
+	}
+
+	// Parse the request body, the contact is made by the assigned collector today unless told otherwise
+	var contact ContactAttempt
+	if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	contact.CaseID = collectionCase.CaseID
+	if contact.ContactDate.IsZero() {
+		contact.ContactDate = Loan_Submits.CustomDate{Time: time.Now()}
+	}
+	if contact.Collector == "" {
+		contact.Collector = collectionCase.Collector
+	}
+
+	var validationError string
+	switch {
+	case contact.Channel != "phone" && contact.Channel != "sms" && contact.Channel != "email" && contact.Channel != "letter" && contact.Channel != "visit":
+		validationError = "Invalid Channel. Allowed values are 'phone', 'sms', 'email', 'letter' or 'visit'"
+	case contact.Outcome != "reached" && contact.Outcome != "no_answer" && contact.Outcome != "wrong_number" && contact.Outcome != "refused" && contact.Outcome != "promised":
+		validationError = "Invalid Outcome. Allowed values are 'reached', 'no_answer', 'wrong_number', 'refused' or 'promised'"
+	case !isCollector(contact.Collector):
+		validationError = fmt.Sprintf("Unknown collector '%s'", contact.Collector)
+	}
+	if validationError != "" {
+		errorResponse := map[string]string{"error": validationError}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	query := `INSERT INTO contact_attempts (case_id, contact_date, channel, outcome, collector, notes)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING contact_id, created_at`
+	err = db.QueryRow(query, contact.CaseID, contact.ContactDate, contact.Channel, contact.Outcome, contact.Collector, contact.Notes).
+		Scan(&contact.ContactID, &contact.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Set Content-Type and return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated) // HTTP 201 Created
+	json.NewEncoder(w).Encode(contact)
+}
+
+func CreatePromiseToPay(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLoanCollectionsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	collectionCase, ok := findOpenCase(w, db, r)
+	if !ok {
+		return
+	}
+
+	// Parse the request body, the promise is made today unless told otherwise
+	var promise PromiseToPay
+	if err := json.NewDecoder(r.Body).Decode(&promise); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	promise.CaseID = collectionCase.CaseID
+	promise.PromiseStatus = "pending"
+	promise.PaidAmount = decimal.Zero
+	if promise.PromiseMadeDate.IsZero() {
+		promise.PromiseMadeDate = Loan_Submits.CustomDate{Time: truncateToDay(time.Now())}
+	}
+
+	var validationError string
+	switch {
+	case !promise.PromisedAmount.IsPositive():
+		validationError = "PromisedAmount must be greater than zero"
+	case promise.PromisedDate.IsZero():
+		validationError = "PromisedDate is required"
+	case promise.PromisedDate.Before(promise.PromiseMadeDate.Time):
+		validationError = "PromisedDate must not be before PromiseMadeDate"
+	case collectionCase.CaseStatus == "promised":
+		validationError = fmt.Sprintf("Collection case %d already has a pending promise to pay", collectionCase.CaseID)
+	}
+	if validationError != "" {
+		errorResponse := map[string]string{"error": validationError}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Record the promise and put the case on hold until the promised date
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO promises_to_pay (case_id, promised_amount, promised_date, promise_made_date, promise_status)
+		VALUES ($1, $2, $3, $4, $5) RETURNING promise_id, created_at`
+	err = tx.QueryRow(query, promise.CaseID, promise.PromisedAmount, promise.PromisedDate, promise.PromiseMadeDate, promise.PromiseStatus).
+		Scan(&promise.PromiseID, &promise.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE collection_cases SET case_status = 'promised', updated_at = CURRENT_TIMESTAMP WHERE case_id = $1`, promise.CaseID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Set Content-Type and return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated) // HTTP 201 Created
+	json.NewEncoder(w).Encode(promise)
+}
@@ -0,0 +1,220 @@
+package Loan_Collections
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Delinquency"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Payments"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/shopspring/decimal"
+)
+
+// ReviewCases brings the collection cases in line with a delinquency snapshot. Pending promises are
+// checked against the payments received, cases of loans that are current again, paid off or written
+// off are closed, the others are escalated on a broken promise or when they reach EscalateDaysPastDue,
+// and loans that have become delinquent enough get a new case. It runs after every delinquency job, and
+// only against today's snapshots so that a replayed date never closes or escalates live cases.
+func ReviewCases(snapshots []Loan_Delinquency.DelinquencySnapshot, asOf time.Time) error {
+	if !truncateToDay(asOf).Equal(truncateToDay(time.Now())) {
+		return nil
+	}
+
+	db, err := connectLoanCollectionsDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	byLoan := make(map[int]Loan_Delinquency.DelinquencySnapshot)
+	for _, snapshot := range snapshots {
+		byLoan[snapshot.LoanSubmitID] = snapshot
+	}
+
+	rows, err := db.Query("SELECT " + collectionCaseColumns + " FROM collection_cases WHERE case_status <> 'closed' ORDER BY case_id")
+	if err != nil {
+		return fmt.Errorf("error querying collection cases: %v", err)
+	}
+	var collectionCases []CollectionCase
+	for rows.Next() {
+		var collectionCase CollectionCase
+		if err := scanCollectionCase(rows, &collectionCase); err != nil {
+			rows.Close()
+			return err
+		}
+		collectionCases = append(collectionCases, collectionCase)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	hasCase := make(map[int]bool)
+	for _, collectionCase := range collectionCases {
+		hasCase[collectionCase.LoanSubmitID] = true
+		if err := reviewCase(db, collectionCase, byLoan, asOf); err != nil {
+			return fmt.Errorf("error reviewing collection case %d: %v", collectionCase.CaseID, err)
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		if hasCase[snapshot.LoanSubmitID] || snapshot.DaysPastDue < collectionsPolicy.OpenDaysPastDue {
+			continue
+		}
+		if err := openCase(db, snapshot, asOf); err != nil {
+			return fmt.Errorf("error opening collection case for loan submit %d: %v", snapshot.LoanSubmitID, err)
+		}
+	}
+	return nil
+}
+
+// ReviewAfterPayment reviews the open collection case of the loan a new payment was made on against its
+// delinquency as of today, so that a kept promise, a cured or a paid-off loan closes the case right away
+func ReviewAfterPayment(payment Loan_Payments.LoanPayment) error {
+	db, err := connectLoanCollectionsDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var collectionCase CollectionCase
+	query := "SELECT " + collectionCaseColumns + " FROM collection_cases WHERE loanSubmit_id = $1 AND case_status <> 'closed' ORDER BY case_id DESC LIMIT 1"
+	err = scanCollectionCase(db.QueryRow(query, payment.LoanSubmitID), &collectionCase)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	asOf := truncateToDay(time.Now())
+	byLoan := make(map[int]Loan_Delinquency.DelinquencySnapshot)
+	loanSubmit, err := Loan_Submits.FindLoanSubmit(payment.LoanSubmitID)
+	if err != nil {
+		return err
+	}
+	if loanSubmit.LoanStatus == "ongoing" {
+		snapshot, err := Loan_Delinquency.EvaluateDelinquency(payment.LoanSubmitID, asOf)
+		if err != nil {
+			return err
+		}
+		byLoan[payment.LoanSubmitID] = snapshot
+	}
+	if err := reviewCase(db, collectionCase, byLoan, asOf); err != nil {
+		return fmt.Errorf("error reviewing collection case %d: %v", collectionCase.CaseID, err)
+	}
+	return nil
+}
+
+func reviewCase(db *sql.DB, collectionCase CollectionCase, byLoan map[int]Loan_Delinquency.DelinquencySnapshot, asOf time.Time) error {
+	snapshot, ongoing := byLoan[collectionCase.LoanSubmitID]
+	if !ongoing {
+		// A deleted loan was neither repaid nor written off, nothing is recovered by closing its case
+		loanSubmit, err := Loan_Submits.FindLoanSubmit(collectionCase.LoanSubmitID)
+		if err == sql.ErrNoRows {
+			return closeCase(db, collectionCase.CaseID, "loan_deleted", asOf)
+		} else if err != nil {
+			return err
+		}
+		switch loanSubmit.LoanStatus {
+		case "written_off":
+			return closeCase(db, collectionCase.CaseID, "written_off", asOf)
+		case "completed":
+			return closeCase(db, collectionCase.CaseID, "paid_off", asOf)
+		}
+		// An ongoing loan the delinquency job couldn't evaluate keeps its case as it is
+		return nil
+	}
+
+	// Settle the pending promise, a broken promise escalates the case
+	escalate := false
+	promised := false
+	var promise PromiseToPay
+	err := scanPromise(db.QueryRow("SELECT "+promiseColumns+" FROM promises_to_pay WHERE case_id = $1 AND promise_status = 'pending'", collectionCase.CaseID), &promise)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		paid, err := paidBetween(collectionCase.LoanSubmitID, promise.PromiseMadeDate.Time, promise.PromisedDate.Time)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !paid.LessThan(promise.PromisedAmount):
+			promise.PromiseStatus = "kept"
+		case asOf.After(promise.PromisedDate.Time):
+			promise.PromiseStatus = "broken"
+			escalate = true
+		default:
+			promised = true
+		}
+		if _, err := db.Exec(`UPDATE promises_to_pay SET promise_status = $1, paid_amount = $2 WHERE promise_id = $3`,
+			promise.PromiseStatus, paid, promise.PromiseID); err != nil {
+			return err
+		}
+	}
+
+	if snapshot.DaysPastDue == 0 {
+		return closeCase(db, collectionCase.CaseID, "cured", asOf)
+	}
+	if snapshot.DaysPastDue >= collectionsPolicy.EscalateDaysPastDue && collectionCase.DaysPastDue < collectionsPolicy.EscalateDaysPastDue {
+		escalate = true
+	}
+
+	status := "open"
+	switch {
+	case promised:
+		status = "promised"
+	case escalate || collectionCase.EscalationLevel > 0:
+		status = "escalated"
+	}
+	level := collectionCase.EscalationLevel
+	if escalate {
+		level++
+	}
+	_, err = db.Exec(`UPDATE collection_cases SET case_status = $1, escalation_level = $2, days_past_due = $3, overdue_amount = $4,
+		updated_at = CURRENT_TIMESTAMP WHERE case_id = $5`, status, level, snapshot.DaysPastDue, snapshot.OverdueAmount, collectionCase.CaseID)
+	return err
+}
+
+// paidBetween returns the payments received on a loan submit from one date up to another, inclusive
+func paidBetween(loanSubmitID int, from time.Time, to time.Time) (decimal.Decimal, error) {
+	payments, err := Loan_Payments.ReceivedPayments(loanSubmitID)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	paid := decimal.Zero
+	for _, payment := range payments {
+		date := truncateToDay(payment.PaymentDate.Time)
+		if !date.Before(truncateToDay(from)) && !date.After(truncateToDay(to)) {
+			paid = paid.Add(payment.PaymentAmount)
+		}
+	}
+	return paid, nil
+}
+
+func closeCase(db *sql.DB, caseID int, reason string, asOf time.Time) error {
+	_, err := db.Exec(`UPDATE collection_cases SET case_status = 'closed', close_reason = $1, closed_date = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE case_id = $3`, reason, asOf.Format("2006-01-02"), caseID)
+	return err
+}
+
+// openCase creates a case for a delinquent loan and assigns it to the least busy collector. A loan
+// already past EscalateDaysPastDue starts out escalated.
+func openCase(db *sql.DB, snapshot Loan_Delinquency.DelinquencySnapshot, asOf time.Time) error {
+	collector, err := nextCollector(db)
+	if err != nil {
+		return err
+	}
+	status, level := "open", 0
+	if snapshot.DaysPastDue >= collectionsPolicy.EscalateDaysPastDue {
+		status, level = "escalated", 1
+	}
+	_, err = db.Exec(`INSERT INTO collection_cases (loanSubmit_id, collector, case_status, escalation_level, days_past_due, overdue_amount, opened_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, snapshot.LoanSubmitID, collector, status, level, snapshot.DaysPastDue, snapshot.OverdueAmount, asOf.Format("2006-01-02"))
+	return err
+}
+
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,162 @@
+package Loan_Documents
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// StoragePolicy decides where document contents are kept and what may be uploaded. Backend is
+// 'filesystem', keeping files under Root, or 's3' for an S3-compatible object store such as MinIO.
+type StoragePolicy struct {
+	Backend             string
+	Root                string
+	S3                  S3Settings
+	MaxSizeBytes        int64
+	AllowedContentTypes []string
+}
+
+// S3Settings locate the bucket documents are kept in on an S3-compatible object store
+type S3Settings struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
+}
+
+// documentStore keeps the contents of documents under a storage key
+type documentStore interface {
+	Put(key string, content []byte, contentType string) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+var (
+	storagePolicy StoragePolicy
+	store         documentStore
+)
+
+func readStoragePolicyFromFile(filename string) (StoragePolicy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return StoragePolicy{}, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var policy StoragePolicy
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&policy); err != nil {
+		return StoragePolicy{}, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	if policy.MaxSizeBytes <= 0 || len(policy.AllowedContentTypes) == 0 {
+		return StoragePolicy{}, fmt.Errorf("invalid document storage policy: MaxSizeBytes and AllowedContentTypes are required")
+	}
+	return policy, nil
+}
+
+// openStore connects to the backend of the storage policy
+func openStore(policy StoragePolicy) (documentStore, error) {
+	switch policy.Backend {
+	case "filesystem":
+		if err := os.MkdirAll(policy.Root, 0o750); err != nil {
+			return nil, fmt.Errorf("error creating document root: %v", err)
+		}
+		return fileStore{root: policy.Root}, nil
+	case "s3":
+		client, err := minio.New(policy.S3.Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(policy.S3.AccessKey, policy.S3.SecretKey, ""),
+			Secure: policy.S3.UseSSL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to the object store: %v", err)
+		}
+		ctx := context.Background()
+		exists, err := client.BucketExists(ctx, policy.S3.Bucket)
+		if err != nil {
+			return nil, fmt.Errorf("error checking bucket %s: %v", policy.S3.Bucket, err)
+		}
+		if !exists {
+			if err := client.MakeBucket(ctx, policy.S3.Bucket, minio.MakeBucketOptions{}); err != nil {
+				return nil, fmt.Errorf("error creating bucket %s: %v", policy.S3.Bucket, err)
+			}
+		}
+		return s3Store{client: client, bucket: policy.S3.Bucket}, nil
+	default:
+		return nil, fmt.Errorf("invalid document storage policy: Backend must be 'filesystem' or 's3'")
+	}
+}
+
+// fileStore keeps documents as files under a root directory
+type fileStore struct {
+	root string
+}
+
+func (fs fileStore) path(key string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(key))
+}
+
+func (fs fileStore) Put(key string, content []byte, contentType string) error {
+	path := fs.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a failed upload never leaves half a document behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (fs fileStore) Get(key string) ([]byte, error) {
+	return os.ReadFile(fs.path(key))
+}
+
+func (fs fileStore) Delete(key string) error {
+	if err := os.Remove(fs.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// s3Store keeps documents as objects in a bucket of an S3-compatible object store
+type s3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s s3Store) Put(key string, content []byte, contentType string) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, key, bytes.NewReader(content), int64(len(content)),
+		minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s s3Store) Get(key string) ([]byte, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return io.ReadAll(object)
+}
+
+func (s s3Store) Delete(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+}
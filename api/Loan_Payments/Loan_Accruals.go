@@ -0,0 +1,84 @@
+package Loan_Payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/shopspring/decimal"
+)
+
+// AccrueLoanInterest books the interest earned on a loan submit up to the given date. It accrues on the
+// schedule as the payments of the loan leave it, so interest waived by a prepayment is never earned. A
+// loan that is no longer ongoing has earned the interest paid on it and no more.
+func AccrueLoanInterest(loanSubmit Loan_Submits.LoanSubmit, asOf time.Time) (decimal.Decimal, error) {
+	settlement, _, err := EvaluateLoan(loanSubmit.LoanSubmitID, asOf)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	capitalized, err := Loan_Submits.CapitalizedInterest(loanSubmit.LoanSubmitID, asOf)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	accrued := decimal.Zero
+	if loanSubmit.LoanStatus == "ongoing" {
+		var schedule []Loan_Submits.Installment
+		for _, balance := range settlement.Installments {
+			schedule = append(schedule, Loan_Submits.Installment{
+				InstallmentNo: balance.InstallmentNo,
+				PeriodStart:   balance.PeriodStart,
+				DueDate:       balance.DueDate,
+				PrincipalDue:  balance.PrincipalDue,
+				InterestDue:   balance.InterestDue,
+				InterestRate:  balance.InterestRate,
+			})
+		}
+		accrued = Loan_Submits.AccruedInterest(loanSubmit, schedule, asOf)
+	} else {
+		for _, balance := range settlement.Installments {
+			accrued = accrued.Add(balance.InterestPaid)
+		}
+	}
+	accrued = accrued.Add(capitalized)
+
+	if err := Loan_Submits.PostInterestAccrual(loanSubmit.LoanSubmitID, accrued, asOf); err != nil {
+		return decimal.Zero, err
+	}
+	return accrued, nil
+}
+
+func AccrueInterest(w http.ResponseWriter, r *http.Request) {
+	// Interest stops accruing on a loan once it is written off, completed loans are trued up to the
+	// interest paid on them
+	var loanSubmits []Loan_Submits.LoanSubmit
+	for _, loanStatus := range []string{"ongoing", "completed"} {
+		loans, err := Loan_Submits.ListLoanSubmits(loanStatus)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		loanSubmits = append(loanSubmits, loans...)
+	}
+
+	// Book the interest earned on every loan up to today
+	asOf := time.Now()
+	accruedByLoan := make(map[int]decimal.Decimal)
+	for _, loanSubmit := range loanSubmits {
+		accrued, err := AccrueLoanInterest(loanSubmit, asOf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		accruedByLoan[loanSubmit.LoanSubmitID] = accrued
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":          fmt.Sprintf("Interest accrued on %d loan submissions up to %s", len(loanSubmits), asOf.Format("2006-01-02")),
+		"accrued_interest": accruedByLoan,
+	})
+}
@@ -0,0 +1,569 @@
+package Loan_Payments
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/shopspring/decimal"
+)
+
+// LoanFee is an origination fee, late fee, penalty interest or prepayment penalty charged on a loan
+type LoanFee struct {
+	LoanFeeID     int
+	LoanSubmitID  int
+	InstallmentNo int
+	FeeType       string
+	FeeAmount     decimal.Decimal
+	PaidAmount    decimal.Decimal
+	AssessedDate  CustomDate
+	CreatedAt     string
+}
+
+// PaymentAllocation records how much of a loan payment settled a fee, interest or principal
+type PaymentAllocation struct {
+	AllocationID    int
+	LoanPaymentID   int
+	LoanSubmitID    int
+	InstallmentNo   int
+	Component       string
+	LoanFeeID       int
+	AllocatedAmount decimal.Decimal
+	CreatedAt       string
+
+	feeIndex int // position in LoanSettlement.Fees until the fee has been stored
+}
+
+// InstallmentBalance is the paid and outstanding position of one installment. PrincipalDue and
+// InterestDue reflect the schedule as recalculated after any prepayments and restructures.
+type InstallmentBalance struct {
+	InstallmentNo int
+	PeriodStart   Loan_Submits.CustomDate
+	DueDate       Loan_Submits.CustomDate
+	PrincipalDue  decimal.Decimal
+	InterestDue   decimal.Decimal
+	InterestRate  decimal.Decimal
+	PrincipalPaid decimal.Decimal
+	InterestPaid  decimal.Decimal
+}
+
+// PaymentSummary describes how a payment was treated when it was received: the part that settled
+// amounts already due, principal prepaid ahead of schedule with its penalty, and any excess held as
+// credit balance
+type PaymentSummary struct {
+	LoanPaymentID     int
+	PaymentAmount     decimal.Decimal
+	AppliedToDue      decimal.Decimal
+	PrepaidPrincipal  decimal.Decimal
+	PrepaymentPenalty decimal.Decimal
+	HeldAsCredit      decimal.Decimal
+}
+
+// LoanSettlement is the result of replaying every payment of a loan against its schedule
+type LoanSettlement struct {
+	LoanSubmitID         int
+	AsOf                 CustomDate
+	Installments         []InstallmentBalance
+	Fees                 []LoanFee
+	Allocations          []PaymentAllocation
+	Payments             []PaymentSummary
+	Unapplied            decimal.Decimal
+	OutstandingPrincipal decimal.Decimal
+	OutstandingInterest  decimal.Decimal
+	OutstandingFees      decimal.Decimal
+}
+
+type installmentState struct {
+	InstallmentBalance
+	overdueFrom      time.Time
+	lateFeeAssessed  bool
+	penaltyAccruedTo time.Time
+}
+
+// creditBalance is money received that hasn't been allocated yet, kept per payment so that it is
+// allocated under the payment it came from once something falls due
+type creditBalance struct {
+	loanPaymentID int
+	loanSubmitID  int
+	amount        decimal.Decimal
+}
+
+type allocationRun struct {
+	settlement LoanSettlement
+	states     []*installmentState
+	credits    []creditBalance
+	penalty    PenaltyPolicy
+	prepayment PrepaymentPolicy
+}
+
+// EvaluateLoan replays the payments of a loan submit against its schedule as of the given date without
+// storing the result. Any extra payments are replayed as if they had already been recorded.
+func EvaluateLoan(loanSubmitID int, asOf time.Time, extra ...LoanPayment) (LoanSettlement, []LoanPayment, error) {
+	loanSubmit, versions, err := Loan_Submits.GetLoanSchedule(loanSubmitID)
+	if err != nil {
+		return LoanSettlement{}, nil, err
+	}
+	return evaluateSchedule(loanSubmit, versions, asOf, extra...)
+}
+
+// EvaluateSchedule replays the payments of a loan submit against the given schedule versions as of the
+// given date without storing the result, to see how a loan would stand on a proposed schedule
+func EvaluateSchedule(loanSubmit Loan_Submits.LoanSubmit, versions []Loan_Submits.ScheduleVersion, asOf time.Time) (LoanSettlement, error) {
+	settlement, _, err := evaluateSchedule(loanSubmit, versions, asOf)
+	return settlement, err
+}
+
+func evaluateSchedule(loanSubmit Loan_Submits.LoanSubmit, versions []Loan_Submits.ScheduleVersion, asOf time.Time, extra ...LoanPayment) (LoanSettlement, []LoanPayment, error) {
+	loanSubmitID := loanSubmit.LoanSubmitID
+	penalty, upfrontFees, err := productTerms(loanSubmit)
+	if err != nil {
+		return LoanSettlement{}, nil, err
+	}
+
+	db, err := connectLoanPaymentsDB()
+	if err != nil {
+		return LoanSettlement{}, nil, err
+	}
+	defer db.Close()
+
+	payments, err := loadLoanPayments(db, loanSubmitID)
+	if err != nil {
+		return LoanSettlement{}, nil, err
+	}
+	payments = append(payments, extra...)
+
+	// A written-off loan stands as it did when it was written off
+	if loanSubmit.LoanStatus == "written_off" {
+		writeOff, err := findWriteOff(db, loanSubmitID)
+		if err != nil {
+			return LoanSettlement{}, nil, fmt.Errorf("error finding write-off of loan submit %d: %v", loanSubmitID, err)
+		}
+		if writeOff.WriteOffDate.Before(asOf) {
+			asOf = writeOff.WriteOffDate.Time
+		}
+	}
+
+	settlement := allocatePayments(versions, upfrontFees, payments, penalty, prepaymentPolicy, asOf)
+	settlement.LoanSubmitID = loanSubmitID
+	return settlement, payments, nil
+}
+
+// SettleLoan replays the payments of a loan submit in date order against its schedule as of the given
+// date, assessing penalties and allocating each payment, and stores the resulting fees and allocations
+func SettleLoan(loanSubmitID int, asOf time.Time) (LoanSettlement, error) {
+	settlement, payments, err := EvaluateLoan(loanSubmitID, asOf)
+	if err != nil {
+		return LoanSettlement{}, err
+	}
+
+	db, err := connectLoanPaymentsDB()
+	if err != nil {
+		return LoanSettlement{}, err
+	}
+	defer db.Close()
+
+	if err := saveLoanSettlement(db, &settlement); err != nil {
+		return LoanSettlement{}, err
+	}
+	if err := postLoanPayments(loanSubmitID, payments, settlement); err != nil {
+		return LoanSettlement{}, err
+	}
+
+	// Keep the balance and status of the loan in line with what has been paid
+	fullyPaid := settlement.OutstandingPrincipal.Add(settlement.OutstandingInterest).Add(settlement.OutstandingFees).IsZero()
+	if err := Loan_Submits.UpdateLoanBalance(loanSubmitID, settlement.OutstandingPrincipal, fullyPaid); err != nil {
+		return LoanSettlement{}, err
+	}
+	return settlement, nil
+}
+
+// allocatePayments walks through the due dates, overdue dates and payment dates of a loan in order,
+// starting with the upfront fees charged when the loan was granted.
+// On each date penalties are assessed first, then any credit balance is used for whatever has fallen
+// due, and then the payments made that day are allocated by applyPayment. A schedule version taking
+// effect that day replaces the remaining installments last.
+func allocatePayments(versions []Loan_Submits.ScheduleVersion, upfrontFees []LoanFee, payments []LoanPayment, penalty PenaltyPolicy, prepayment PrepaymentPolicy, asOf time.Time) LoanSettlement {
+	asOf = truncateToDay(asOf)
+	run := &allocationRun{
+		penalty:    penalty,
+		prepayment: prepayment,
+	}
+
+	run.states = run.newStates(versions[0].Installments)
+	run.settlement.Fees = append(run.settlement.Fees, upfrontFees...)
+
+	// A reversed payment is replayed as if it had never been received, so neither it nor its
+	// compensating reversal entry take part in the allocation. Recoveries on a written-off loan are
+	// booked as income and aren't allocated either.
+	var allocated []LoanPayment
+	for _, payment := range effectivePayments(payments) {
+		if payment.PaymentType != "recovery" {
+			allocated = append(allocated, payment)
+		}
+	}
+	payments = allocated
+
+	sort.SliceStable(payments, func(i, j int) bool {
+		if payments[i].PaymentDate.Equal(payments[j].PaymentDate.Time) {
+			return payments[i].LoanPaymentID < payments[j].LoanPaymentID
+		}
+		return payments[i].PaymentDate.Before(payments[j].PaymentDate.Time)
+	})
+
+	// Collect every date on which something happens, on any version of the schedule
+	var dates []time.Time
+	for i, version := range versions {
+		for _, state := range run.newStates(version.Installments) {
+			for _, date := range []time.Time{truncateToDay(state.DueDate.Time), state.overdueFrom} {
+				if !date.After(asOf) {
+					dates = append(dates, date)
+				}
+			}
+		}
+		if effectiveDate := truncateToDay(version.EffectiveDate.Time); i > 0 && !effectiveDate.After(asOf) {
+			dates = append(dates, effectiveDate)
+		}
+	}
+	for _, payment := range payments {
+		dates = append(dates, truncateToDay(payment.PaymentDate.Time))
+	}
+	dates = append(dates, asOf)
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+
+	next := 0
+	nextVersion := 1
+	for i, date := range dates {
+		if i > 0 && date.Equal(dates[i-1]) {
+			continue
+		}
+		assessPenalties(&run.settlement, run.states, penalty, date)
+		run.applyCredit(date)
+		for next < len(payments) && !truncateToDay(payments[next].PaymentDate.Time).After(date) {
+			run.applyPayment(payments[next], date)
+			next++
+		}
+		for nextVersion < len(versions) && !truncateToDay(versions[nextVersion].EffectiveDate.Time).After(date) {
+			run.restructure(versions[nextVersion], date)
+			nextVersion++
+		}
+	}
+
+	settlement := run.settlement
+	settlement.AsOf = CustomDate{Time: dates[len(dates)-1]}
+	settlement.Unapplied = decimal.Zero
+	settlement.OutstandingPrincipal = decimal.Zero
+	settlement.OutstandingInterest = decimal.Zero
+	settlement.OutstandingFees = decimal.Zero
+	for _, credit := range run.credits {
+		settlement.Unapplied = settlement.Unapplied.Add(credit.amount)
+	}
+	for _, state := range run.states {
+		settlement.Installments = append(settlement.Installments, state.InstallmentBalance)
+		settlement.OutstandingPrincipal = settlement.OutstandingPrincipal.Add(state.PrincipalDue.Sub(state.PrincipalPaid))
+		settlement.OutstandingInterest = settlement.OutstandingInterest.Add(state.InterestDue.Sub(state.InterestPaid))
+	}
+	for _, fee := range settlement.Fees {
+		settlement.OutstandingFees = settlement.OutstandingFees.Add(fee.FeeAmount.Sub(fee.PaidAmount))
+	}
+	return settlement
+}
+
+// newStates returns the replay state of the given installments in due date order
+func (run *allocationRun) newStates(installments []Loan_Submits.Installment) []*installmentState {
+	var states []*installmentState
+	for _, installment := range installments {
+		states = append(states, &installmentState{
+			InstallmentBalance: InstallmentBalance{
+				InstallmentNo: installment.InstallmentNo,
+				PeriodStart:   installment.PeriodStart,
+				DueDate:       installment.DueDate,
+				PrincipalDue:  installment.PrincipalDue,
+				InterestDue:   installment.InterestDue,
+				InterestRate:  installment.InterestRate,
+				PrincipalPaid: decimal.Zero,
+				InterestPaid:  decimal.Zero,
+			},
+			overdueFrom: run.penalty.OverdueFrom(truncateToDay(installment.DueDate.Time)),
+		})
+	}
+	sort.SliceStable(states, func(i, j int) bool { return states[i].DueDate.Before(states[j].DueDate.Time) })
+	return states
+}
+
+// restructure switches the replay over to a new schedule version on its effective date. Installments
+// already due are kept as they stand, unless the arrears on them are capitalized, in which case they
+// are reduced to what has been paid. The principal still outstanding on the later installments, plus
+// any capitalized arrears, is rescheduled over the due dates of the new version at its interest rate.
+// Interest accrued on the current period up to the effective date is carried over to the first
+// rescheduled installment. The principal is worked out at replay time, so the new version stays
+// correct if a payment made before the restructure is later reversed.
+func (run *allocationRun) restructure(version Loan_Submits.ScheduleVersion, date time.Time) {
+	var kept []*installmentState
+	principal := decimal.Zero
+	carried := decimal.Zero
+	for _, state := range run.states {
+		if !state.DueDate.After(date) {
+			kept = append(kept, state)
+			continue
+		}
+
+		outstanding := state.PrincipalDue.Sub(state.PrincipalPaid)
+		principal = principal.Add(outstanding)
+		if periodStart := truncateToDay(state.PeriodStart.Time); date.After(periodStart) {
+			days := int(date.Sub(periodStart).Hours() / 24)
+			accrued := decimal.Zero
+			for _, future := range run.states {
+				if future.DueDate.After(date) && !future.DueDate.Before(state.DueDate.Time) {
+					accrued = accrued.Add(future.PrincipalDue.Sub(future.PrincipalPaid))
+				}
+			}
+			accrued = accrued.
+				Mul(state.InterestRate).
+				Div(decimal.NewFromInt(100)).
+				Mul(decimal.NewFromInt(int64(days))).
+				Div(decimal.NewFromInt(365)).
+				Round(2)
+			carried = carried.Add(decimal.Max(decimal.Zero, decimal.Min(accrued, state.InterestDue).Sub(state.InterestPaid)))
+		}
+	}
+
+	if version.CapitalizeArrears {
+		for _, state := range kept {
+			principal = principal.Add(state.PrincipalDue.Sub(state.PrincipalPaid)).Add(state.InterestDue.Sub(state.InterestPaid))
+			state.PrincipalDue = state.PrincipalPaid
+			state.InterestDue = state.InterestPaid
+		}
+	}
+
+	var dueDates []time.Time
+	firstInstallmentNo := 0
+	for _, installment := range version.Installments {
+		if installment.DueDate.After(date) {
+			if firstInstallmentNo == 0 {
+				firstInstallmentNo = installment.InstallmentNo
+			}
+			dueDates = append(dueDates, installment.DueDate.Time)
+		}
+	}
+	if len(dueDates) == 0 {
+		return
+	}
+	sort.Slice(dueDates, func(i, j int) bool { return dueDates[i].Before(dueDates[j]) })
+
+	rescheduled := Loan_Submits.GenerateInstallments(principal, version.InterestRate, date, dueDates, firstInstallmentNo)
+	rescheduled[0].InterestDue = rescheduled[0].InterestDue.Add(carried)
+	run.states = append(kept, run.newStates(rescheduled)...)
+}
+
+// applyPayment settles what is due on the payment date: fees first (oldest first), then the interest
+// and principal of each due installment in due date order. Whatever is left is prepaid or held as
+// credit balance depending on the prepayment policy.
+func (run *allocationRun) applyPayment(payment LoanPayment, date time.Time) {
+	// A refund pays back part of the borrower's credit balance
+	if payment.PaymentType == "refund" {
+		run.useCredit(payment.PaymentAmount.Neg())
+		return
+	}
+
+	summary := PaymentSummary{
+		LoanPaymentID:     payment.LoanPaymentID,
+		PaymentAmount:     payment.PaymentAmount,
+		PrepaidPrincipal:  decimal.Zero,
+		PrepaymentPenalty: decimal.Zero,
+		HeldAsCredit:      decimal.Zero,
+	}
+
+	remaining := run.settleDue(payment.LoanPaymentID, payment.LoanSubmitID, payment.PaymentAmount, date)
+	summary.AppliedToDue = payment.PaymentAmount.Sub(remaining)
+
+	if remaining.IsPositive() && run.prepayment.allowsPrepayment() {
+		prepaid, penalty := run.prepay(payment.LoanPaymentID, payment.LoanSubmitID, remaining, date)
+		summary.PrepaidPrincipal = prepaid
+		summary.PrepaymentPenalty = penalty
+		remaining = remaining.Sub(prepaid).Sub(penalty)
+	}
+
+	if remaining.IsPositive() {
+		summary.HeldAsCredit = remaining
+		run.credits = append(run.credits, creditBalance{loanPaymentID: payment.LoanPaymentID, loanSubmitID: payment.LoanSubmitID, amount: remaining})
+	}
+	run.settlement.Payments = append(run.settlement.Payments, summary)
+}
+
+// applyCredit uses the credit balance, oldest first, for whatever has fallen due by the given date
+func (run *allocationRun) applyCredit(date time.Time) {
+	var kept []creditBalance
+	for _, credit := range run.credits {
+		credit.amount = run.settleDue(credit.loanPaymentID, credit.loanSubmitID, credit.amount, date)
+		if credit.amount.IsPositive() {
+			kept = append(kept, credit)
+		}
+	}
+	run.credits = kept
+}
+
+// useCredit takes the given amount out of the credit balance, oldest first
+func (run *allocationRun) useCredit(amount decimal.Decimal) {
+	var kept []creditBalance
+	for _, credit := range run.credits {
+		used := decimal.Min(amount, credit.amount)
+		amount = amount.Sub(used)
+		credit.amount = credit.amount.Sub(used)
+		if credit.amount.IsPositive() {
+			kept = append(kept, credit)
+		}
+	}
+	run.credits = kept
+}
+
+// settleDue allocates an amount to the fees charged so far and to the installments due by the given
+// date, and returns what is left of it
+func (run *allocationRun) settleDue(loanPaymentID int, loanSubmitID int, amount decimal.Decimal, date time.Time) decimal.Decimal {
+	remaining := amount
+
+	// Fees are settled first, oldest first
+	for i := range run.settlement.Fees {
+		fee := &run.settlement.Fees[i]
+		paid := run.allocate(loanPaymentID, loanSubmitID, fee.InstallmentNo, "fee", i, &remaining, fee.FeeAmount.Sub(fee.PaidAmount))
+		fee.PaidAmount = fee.PaidAmount.Add(paid)
+	}
+
+	// Then interest and principal of each due installment in due date order
+	for _, state := range run.states {
+		if state.DueDate.After(date) {
+			break
+		}
+		state.InterestPaid = state.InterestPaid.Add(run.allocate(loanPaymentID, loanSubmitID, state.InstallmentNo, "interest", -1, &remaining, state.InterestDue.Sub(state.InterestPaid)))
+		state.PrincipalPaid = state.PrincipalPaid.Add(run.allocate(loanPaymentID, loanSubmitID, state.InstallmentNo, "principal", -1, &remaining, state.PrincipalDue.Sub(state.PrincipalPaid)))
+	}
+	return remaining
+}
+
+// allocate takes up to the outstanding amount out of remaining and records it as an allocation
+func (run *allocationRun) allocate(loanPaymentID int, loanSubmitID int, installmentNo int, component string, feeIndex int, remaining *decimal.Decimal, outstanding decimal.Decimal) decimal.Decimal {
+	if !remaining.IsPositive() || !outstanding.IsPositive() {
+		return decimal.Zero
+	}
+	amount := decimal.Min(*remaining, outstanding)
+	*remaining = remaining.Sub(amount)
+	run.settlement.Allocations = append(run.settlement.Allocations, PaymentAllocation{
+		LoanPaymentID:   loanPaymentID,
+		LoanSubmitID:    loanSubmitID,
+		InstallmentNo:   installmentNo,
+		Component:       component,
+		AllocatedAmount: amount,
+		feeIndex:        feeIndex,
+	})
+	return amount
+}
+
+func saveLoanSettlement(db *sql.DB, settlement *LoanSettlement) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM payment_allocations WHERE loanSubmit_id = $1`, settlement.LoanSubmitID); err != nil {
+		return fmt.Errorf("error clearing payment allocations: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM loan_fees WHERE loanSubmit_id = $1`, settlement.LoanSubmitID); err != nil {
+		return fmt.Errorf("error clearing loan fees: %v", err)
+	}
+
+	feeQuery := `INSERT INTO loan_fees (loanSubmit_id, installment_no, fee_type, fee_amount, paid_amount, assessed_date)
+        VALUES ($1, $2, $3, $4, $5, $6) RETURNING loanFee_id, created_at`
+	for i := range settlement.Fees {
+		fee := &settlement.Fees[i]
+		fee.LoanSubmitID = settlement.LoanSubmitID
+		err := tx.QueryRow(feeQuery, fee.LoanSubmitID, fee.InstallmentNo, fee.FeeType, fee.FeeAmount, fee.PaidAmount, fee.AssessedDate).
+			Scan(&fee.LoanFeeID, &fee.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("error inserting loan fee: %v", err)
+		}
+	}
+
+	allocationQuery := `INSERT INTO payment_allocations (loanPayment_id, loanSubmit_id, installment_no, component, loanFee_id, allocated_amount)
+        VALUES ($1, $2, $3, $4, $5, $6) RETURNING allocation_id, created_at`
+	for i := range settlement.Allocations {
+		allocation := &settlement.Allocations[i]
+		var loanFeeID sql.NullInt64
+		if allocation.feeIndex >= 0 {
+			allocation.LoanFeeID = settlement.Fees[allocation.feeIndex].LoanFeeID
+			loanFeeID = sql.NullInt64{Int64: int64(allocation.LoanFeeID), Valid: true}
+		}
+		err := tx.QueryRow(allocationQuery, allocation.LoanPaymentID, allocation.LoanSubmitID, allocation.InstallmentNo, allocation.Component, loanFeeID, allocation.AllocatedAmount).
+			Scan(&allocation.AllocationID, &allocation.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("error inserting payment allocation: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// loadLoanPayments reads the completed entries of a loan submit in date order. Money isn't received until
+// its payment is completed, so a 'not-complete' payment is neither allocated nor booked.
+func loadLoanPayments(db *sql.DB, loanSubmitID int) ([]LoanPayment, error) {
+	query := "SELECT " + loanPaymentColumns + " FROM loan_payments WHERE loanSubmit_id = $1 AND payment_status = 'completed' ORDER BY payment_date, loanPayment_id"
+	rows, err := db.Query(query, loanSubmitID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []LoanPayment
+	for rows.Next() {
+		var payment LoanPayment
+		if err := scanLoanPayment(rows, &payment); err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, rows.Err()
+}
+
+// effectivePayments drops reversed payments together with their compensating reversal entries
+func effectivePayments(payments []LoanPayment) []LoanPayment {
+	reversed := make(map[int]bool)
+	for _, payment := range payments {
+		if payment.PaymentType == "reversal" {
+			reversed[payment.ReversalOf] = true
+		}
+	}
+	var effective []LoanPayment
+	for _, payment := range payments {
+		if payment.PaymentType != "reversal" && !reversed[payment.LoanPaymentID] {
+			effective = append(effective, payment)
+		}
+	}
+	return effective
+}
+
+// ReceivedPayments returns the money received on a loan submit that hasn't been reversed, in date order.
+// Refunds of credit balance are left out.
+func ReceivedPayments(loanSubmitID int) ([]LoanPayment, error) {
+	db, err := connectLoanPaymentsDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	payments, err := loadLoanPayments(db, loanSubmitID)
+	if err != nil {
+		return nil, err
+	}
+	var received []LoanPayment
+	for _, payment := range effectivePayments(payments) {
+		if payment.PaymentType == "payment" {
+			received = append(received, payment)
+		}
+	}
+	return received, nil
+}
+
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
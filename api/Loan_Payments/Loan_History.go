@@ -0,0 +1,66 @@
+package Loan_Payments
+
+import (
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Calendars"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+)
+
+// InstallmentLateness is how an installment that has fallen due was repaid. DaysLate counts from the
+// business day it fell due until the payment that settled it, or until the date asked about while it
+// is still unpaid.
+type InstallmentLateness struct {
+	InstallmentNo int
+	DueDate       Loan_Submits.CustomDate
+	Settled       bool
+	DaysLate      int
+}
+
+// RepaymentHistory replays the payments of a loan submit as of the given date and returns how each
+// installment that has fallen due by then was repaid
+func RepaymentHistory(loanSubmit Loan_Submits.LoanSubmit, asOf time.Time) ([]InstallmentLateness, error) {
+	asOf = truncateToDay(asOf)
+	settlement, payments, err := EvaluateLoan(loanSubmit.LoanSubmitID, asOf)
+	if err != nil {
+		return nil, err
+	}
+	calendar, err := LoanCalendar(loanSubmit)
+	if err != nil {
+		return nil, err
+	}
+
+	// The last payment allocated to an installment is the one that settled it
+	paymentDates := make(map[int]time.Time)
+	for _, payment := range payments {
+		paymentDates[payment.LoanPaymentID] = truncateToDay(payment.PaymentDate.Time)
+	}
+	lastPaid := make(map[int]time.Time)
+	for _, allocation := range settlement.Allocations {
+		if allocation.Component != "principal" && allocation.Component != "interest" {
+			continue
+		}
+		if date := paymentDates[allocation.LoanPaymentID]; date.After(lastPaid[allocation.InstallmentNo]) {
+			lastPaid[allocation.InstallmentNo] = date
+		}
+	}
+
+	var history []InstallmentLateness
+	for _, installment := range settlement.Installments {
+		dueDate := calendar.AsOf(installment.DueDate.Time).Adjust(truncateToDay(installment.DueDate.Time), Calendars.ConventionFollowing)
+		if dueDate.After(asOf) {
+			continue
+		}
+		lateness := InstallmentLateness{InstallmentNo: installment.InstallmentNo, DueDate: installment.DueDate}
+		settledOn := asOf
+		if installment.PrincipalPaid.Add(installment.InterestPaid).GreaterThanOrEqual(installment.PrincipalDue.Add(installment.InterestDue)) {
+			lateness.Settled = true
+			settledOn = lastPaid[installment.InstallmentNo]
+		}
+		if days := int(settledOn.Sub(dueDate).Hours() / 24); days > 0 {
+			lateness.DaysLate = days
+		}
+		history = append(history, lateness)
+	}
+	return history, nil
+}
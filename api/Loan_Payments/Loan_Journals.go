@@ -0,0 +1,94 @@
+package Loan_Payments
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/General_Ledger"
+	"github.com/shopspring/decimal"
+)
+
+// postLoanPayments books every payment of a loan in the general ledger according to its allocation,
+// and reverses the journals of payments that no longer exist. A reversed payment keeps the journals it
+// was booked with, and its reversal entry books the exact opposite of them.
+func postLoanPayments(loanSubmitID int, payments []LoanPayment, settlement LoanSettlement) error {
+	allocated := make(map[int]map[string]decimal.Decimal)
+	for _, allocation := range settlement.Allocations {
+		if allocated[allocation.LoanPaymentID] == nil {
+			allocated[allocation.LoanPaymentID] = make(map[string]decimal.Decimal)
+		}
+		allocated[allocation.LoanPaymentID][allocation.Component] = allocated[allocation.LoanPaymentID][allocation.Component].Add(allocation.AllocatedAmount)
+	}
+
+	reversed := make(map[int]bool)
+	for _, payment := range payments {
+		if payment.PaymentType == "reversal" {
+			reversed[payment.ReversalOf] = true
+		}
+	}
+
+	current := make(map[int]bool)
+	for _, payment := range payments {
+		current[payment.LoanPaymentID] = true
+		if reversed[payment.LoanPaymentID] {
+			continue
+		}
+
+		var lines []General_Ledger.JournalLine
+		var description string
+		switch payment.PaymentType {
+		case "reversal":
+			original, err := General_Ledger.PostedLines(General_Ledger.SourcePayment, payment.ReversalOf)
+			if err != nil {
+				return err
+			}
+			for _, line := range original {
+				lines = append(lines, General_Ledger.JournalLine{AccountCode: line.AccountCode, Debit: line.Credit, Credit: line.Debit})
+			}
+			description = fmt.Sprintf("Reversal %d of payment %d on loan submit %d", payment.LoanPaymentID, payment.ReversalOf, loanSubmitID)
+		case "refund":
+			amount := payment.PaymentAmount.Neg()
+			lines = []General_Ledger.JournalLine{
+				{AccountCode: General_Ledger.BorrowerCreditAccount, Debit: amount, Credit: decimal.Zero},
+				{AccountCode: General_Ledger.CashAccount, Debit: decimal.Zero, Credit: amount},
+			}
+			description = fmt.Sprintf("Refund %d of credit balance on loan submit %d", payment.LoanPaymentID, loanSubmitID)
+		case "recovery":
+			lines = []General_Ledger.JournalLine{
+				{AccountCode: General_Ledger.CashAccount, Debit: payment.PaymentAmount, Credit: decimal.Zero},
+				{AccountCode: General_Ledger.RecoveryIncomeAccount, Debit: decimal.Zero, Credit: payment.PaymentAmount},
+			}
+			description = fmt.Sprintf("Recovery %d on written-off loan submit %d", payment.LoanPaymentID, loanSubmitID)
+		default:
+			components := allocated[payment.LoanPaymentID]
+			unapplied := payment.PaymentAmount.Sub(components["fee"]).Sub(components["interest"]).Sub(components["principal"])
+			lines = []General_Ledger.JournalLine{
+				{AccountCode: General_Ledger.CashAccount, Debit: payment.PaymentAmount, Credit: decimal.Zero},
+				{AccountCode: General_Ledger.FeeIncomeAccount, Debit: decimal.Zero, Credit: components["fee"]},
+				{AccountCode: General_Ledger.InterestReceivableAccount, Debit: decimal.Zero, Credit: components["interest"]},
+				{AccountCode: General_Ledger.LoanReceivableAccount, Debit: decimal.Zero, Credit: components["principal"]},
+				{AccountCode: General_Ledger.BorrowerCreditAccount, Debit: decimal.Zero, Credit: unapplied},
+			}
+			description = fmt.Sprintf("Payment %d on loan submit %d", payment.LoanPaymentID, loanSubmitID)
+		}
+
+		if err := General_Ledger.SyncJournal(General_Ledger.SourcePayment, payment.LoanPaymentID, loanSubmitID, payment.PaymentDate.Time, description, lines); err != nil {
+			return err
+		}
+	}
+
+	posted, err := General_Ledger.PostedSourceIDs(General_Ledger.SourcePayment, loanSubmitID)
+	if err != nil {
+		return err
+	}
+	for _, loanPaymentID := range posted {
+		if current[loanPaymentID] {
+			continue
+		}
+		description := fmt.Sprintf("Reversal of removed payment %d on loan submit %d", loanPaymentID, loanSubmitID)
+		if err := General_Ledger.SyncJournal(General_Ledger.SourcePayment, loanPaymentID, loanSubmitID, time.Now(), description, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
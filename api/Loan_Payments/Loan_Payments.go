@@ -6,11 +6,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
 	"github.com/gorilla/mux"
 	"github.com/shopspring/decimal"
 )
@@ -76,8 +79,33 @@ type LoanPayment struct {
 	PaymentDate   CustomDate
 	PaymentMethod string
 	PaymentStatus string
-	CreatedAt     string
-	UpdatedAt     string
+	// 'payment' for money received, 'reversal' for the compensating entry of a reversed payment,
+	// 'refund' for a credit balance paid back to the borrower and 'recovery' for money received on a
+	// loan that has been written off
+	PaymentType string
+	ReversalOf  int // loanPayment_id reversed by a 'reversal' entry
+	// Applicant who paid, a party of the loan submit, the primary borrower when not given
+	PayerID   int
+	CreatedAt string
+	UpdatedAt string
+}
+
+// Columns selected into a LoanPayment by scanLoanPayment
+const loanPaymentColumns = "loanPayment_id, loanSubmit_id, payment_amount, payment_date, payment_method, payment_status, payment_type, COALESCE(reversal_of, 0), COALESCE(payer_id, 0), created_at, updated_at"
+
+func scanLoanPayment(row interface{ Scan(...interface{}) error }, payment *LoanPayment) error {
+	return row.Scan(&payment.LoanPaymentID, &payment.LoanSubmitID, &payment.PaymentAmount, &payment.PaymentDate, &payment.PaymentMethod, &payment.PaymentStatus,
+		&payment.PaymentType, &payment.ReversalOf, &payment.PayerID, &payment.CreatedAt, &payment.UpdatedAt)
+}
+
+// PaymentHook is run after a payment has been recorded and allocated
+type PaymentHook func(payment LoanPayment) error
+
+var paymentHooks []PaymentHook
+
+// AfterPayment registers a hook run after every new payment, such as the rescoring of the applicant
+func AfterPayment(hook PaymentHook) {
+	paymentHooks = append(paymentHooks, hook)
 }
 
 func connectLoanPaymentsDB() (*sql.DB, error) {
@@ -105,6 +133,28 @@ func SetupDatabase() {
 		log.Fatal("Error creating loan_submits table:", err)
 	}
 
+	// Create the loan_fees and payment_allocations tables if they don't exist
+	if err := createLoanFeeTables(db); err != nil {
+		log.Fatal("Error creating loan fee tables:", err)
+	}
+
+	// Create the loan_write_offs table if it doesn't exist
+	if err := createWriteOffTable(db); err != nil {
+		log.Fatal("Error creating loan_write_offs table:", err)
+	}
+
+	// Read the penalty policy applied to overdue installments
+	penaltyPolicy, err = readPenaltyPolicyFromFile("json/penalty_policy.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Read the policy applied to payments exceeding what is currently due
+	prepaymentPolicy, err = readPrepaymentPolicyFromFile("json/prepayment_policy.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Read data from JSON file
 	loanpayments, err := readreceiptFromFile("json/receipts.json")
 	if err != nil {
@@ -114,7 +164,14 @@ func SetupDatabase() {
 	// Insert each applicant into the database
 	for _, payments := range loanpayments {
 		pk := InsertLoanSubmit(db, payments)
-		fmt.Printf("Inserted loan payment ID = %d\n", pk)
+		log.Printf("Inserted loan payment ID = %d", pk)
+	}
+
+	// Allocate the seeded payments and book them in the general ledger
+	for _, payments := range loanpayments {
+		if _, err := SettleLoan(payments.LoanSubmitID, time.Now()); err != nil && err != sql.ErrNoRows {
+			log.Fatal(err)
+		}
 	}
 }
 
@@ -134,6 +191,22 @@ func createLoanPaymentTable(db *sql.DB) error {
 	if err != nil {
 		return fmt.Errorf("error creating loan_payments table: %v", err)
 	}
+
+	// Columns added after the table was first created
+	queries := []string{
+		`ALTER TABLE loan_payments ADD COLUMN IF NOT EXISTS payment_type VARCHAR(10) NOT NULL DEFAULT 'payment' CHECK (payment_type IN ('payment', 'reversal', 'refund'))`,
+		`ALTER TABLE loan_payments ADD COLUMN IF NOT EXISTS reversal_of INT REFERENCES loan_payments (loanPayment_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS loan_payments_reversal_of_key ON loan_payments (reversal_of)`,
+		// Payment types allowed, replaced whenever a new type is introduced
+		`ALTER TABLE loan_payments DROP CONSTRAINT IF EXISTS loan_payments_payment_type_check`,
+		`ALTER TABLE loan_payments ADD CONSTRAINT loan_payments_payment_type_check CHECK (payment_type IN ('payment', 'reversal', 'refund', 'recovery'))`,
+		`ALTER TABLE loan_payments ADD COLUMN IF NOT EXISTS payer_id INT`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("error altering loan_payments table: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -168,6 +241,22 @@ func readreceiptFromFile(filename string) ([]LoanPayment, error) {
 	return LoanPayments, nil
 }
 
+// ReassignPayer moves the payments made by an applicant merged into another over to that applicant
+// and returns how many there were
+func ReassignPayer(fromID int, toID int) (int64, error) {
+	db, err := connectLoanPaymentsDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	result, err := db.Exec(`UPDATE loan_payments SET payer_id = $2, updated_at = CURRENT_TIMESTAMP WHERE payer_id = $1`, fromID, toID)
+	if err != nil {
+		return 0, fmt.Errorf("error reassigning payments of applicant %d: %v", fromID, err)
+	}
+	return result.RowsAffected()
+}
+
 func GetLoanPayment(w http.ResponseWriter, r *http.Request) {
 	db, err := connectLoanPaymentsDB()
 	if err != nil {
@@ -176,7 +265,7 @@ func GetLoanPayment(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 
 	// Query from the loan_payments table
-	rows, err := db.Query("SELECT loanPayment_id, loanSubmit_id, payment_amount, payment_date, payment_method, payment_status, created_at, updated_at FROM loan_payments")
+	rows, err := db.Query("SELECT " + loanPaymentColumns + " FROM loan_payments")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -186,7 +275,7 @@ func GetLoanPayment(w http.ResponseWriter, r *http.Request) {
 	var loanPayments []LoanPayment
 	for rows.Next() {
 		var payment LoanPayment
-		if err := rows.Scan(&payment.LoanPaymentID, &payment.LoanSubmitID, &payment.PaymentAmount, &payment.PaymentDate, &payment.PaymentMethod, &payment.PaymentStatus, &payment.CreatedAt, &payment.UpdatedAt); err != nil {
+		if err := scanLoanPayment(rows, &payment); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -220,8 +309,8 @@ func GetLoanPaymentByID(w http.ResponseWriter, r *http.Request) {
 
 	// Query database for loan_payments with given loanPayment_id
 	var loanPayment LoanPayment
-	query := `SELECT loanPayment_id, loanSubmit_id, payment_amount, payment_date, payment_method, payment_status, created_at, updated_at FROM loan_payments WHERE loanPayment_id = $1`
-	err = db.QueryRow(query, id).Scan(&loanPayment.LoanPaymentID, &loanPayment.LoanSubmitID, &loanPayment.PaymentAmount, &loanPayment.PaymentDate, &loanPayment.PaymentMethod, &loanPayment.PaymentStatus, &loanPayment.CreatedAt, &loanPayment.UpdatedAt)
+	query := "SELECT " + loanPaymentColumns + " FROM loan_payments WHERE loanPayment_id = $1"
+	err = scanLoanPayment(db.QueryRow(query, id), &loanPayment)
 	if err == sql.ErrNoRows {
 		// Return JSON error response if no loan payment with the given ID exists
 		errorResponse := map[string]string{"error": "loan_payments data not found"}
@@ -255,15 +344,93 @@ func CreateLoanPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !loanPayment.PaymentAmount.IsPositive() {
+		errorResponse := map[string]string{"error": "Payment amount must be greater than zero"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Make sure the loan submit being paid exists
+	loanSubmit, err := Loan_Submits.FindLoanSubmit(loanPayment.LoanSubmitID)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_submits data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Anyone liable for the loan may pay it
+	if loanPayment.PayerID == 0 {
+		loanPayment.PayerID = loanSubmit.ApplicantID
+	}
+	if status, err := checkPayer(loanPayment.LoanSubmitID, loanPayment.PayerID); err != nil {
+		if status == http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Money received on a written-off loan is a recovery and isn't applied to its schedule
+	loanPayment.PaymentType = "payment"
+	if loanSubmit.LoanStatus == "written_off" {
+		loanPayment.PaymentType = "recovery"
+	}
+
+	// The loan stays locked from the checks until the payment is recorded, see lockLoan
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := lockLoan(tx, loanPayment.LoanSubmitID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Under the 'reject' policy only what is currently due may be paid
+	if prepaymentPolicy.Policy == "reject" && loanPayment.PaymentType == "payment" {
+		preview := loanPayment
+		preview.LoanPaymentID = math.MaxInt32
+		preview.PaymentType = "payment"
+		settlement, _, err := EvaluateLoan(loanPayment.LoanSubmitID, time.Now(), preview)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		summary := findPaymentSummary(settlement, preview.LoanPaymentID)
+		if summary.HeldAsCredit.IsPositive() {
+			errorResponse := map[string]interface{}{
+				"error":      fmt.Sprintf("Payment of %s exceeds the amount currently due of %s", loanPayment.PaymentAmount.StringFixed(2), summary.AppliedToDue.StringFixed(2)),
+				"amount_due": summary.AppliedToDue,
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(errorResponse)
+			return
+		}
+	}
+
 	// Insert loan payments into the database
-	query := `INSERT INTO loan_payments (loanSubmit_id, payment_amount, payment_date, payment_method, payment_status)
-        VALUES ($1, $2, $3, $4, $5) RETURNING loanPayment_id`
+	query := `INSERT INTO loan_payments (loanSubmit_id, payment_amount, payment_date, payment_method, payment_status, payment_type, payer_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING loanPayment_id`
 
 	var loanPaymentID int
 	// Format time.Time to PostgreSQL DATE format
 	paymentDate := loanPayment.PaymentDate.Format("2006-01-02")
 
-	err = db.QueryRow(query, loanPayment.LoanSubmitID, loanPayment.PaymentAmount, paymentDate, loanPayment.PaymentMethod, loanPayment.PaymentStatus).Scan(&loanPaymentID)
+	err = tx.QueryRow(query, loanPayment.LoanSubmitID, loanPayment.PaymentAmount, paymentDate, loanPayment.PaymentMethod, loanPayment.PaymentStatus, loanPayment.PaymentType, loanPayment.PayerID).Scan(&loanPaymentID)
 	if err != nil {
 		if loanPayment.PaymentStatus != "not-complete" && loanPayment.PaymentStatus != "completed" {
 			// If payment status is invalid, return a specific JSON response
@@ -280,11 +447,40 @@ func CreateLoanPayment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Prepare success message with only the relevant ID
 	successMessage := map[string]interface{}{
 		"message":        "Loan payment information has been successfully created.",
 		"loanPayment_id": loanPaymentID, // Use the ID of the newly created payment
+		"payment_type":   loanPayment.PaymentType,
+		"payer_id":       loanPayment.PayerID,
+	}
+
+	// Allocate the payment against fees, interest and principal of the loan. The payment is recorded
+	// whether or not that succeeds, so a failure is reported as a pending settlement rather than an
+	// error the payment would be posted again for.
+	settlement, err := SettleLoan(loanPayment.LoanSubmitID, time.Now())
+	if err != nil {
+		settlementPending(successMessage, loanPayment.LoanSubmitID, err)
+	} else {
+		summary := findPaymentSummary(settlement, loanPaymentID)
+		successMessage["settlement_status"] = "settled"
+		successMessage["applied_to_due"] = summary.AppliedToDue
+		successMessage["prepaid_principal"] = summary.PrepaidPrincipal
+		successMessage["prepayment_penalty"] = summary.PrepaymentPenalty
+		successMessage["held_as_credit"] = summary.HeldAsCredit
+	}
+
+	// A payment that isn't completed yet is received once it is updated to 'completed'
+	loanPayment.LoanPaymentID = loanPaymentID
+	if loanPayment.PaymentStatus == "completed" {
+		runPaymentHooks(loanPayment)
+	} else {
+		successMessage["settlement_status"] = "awaiting_completion"
 	}
 
 	// Set Content-Type and return JSON response
@@ -293,6 +489,24 @@ func CreateLoanPayment(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(successMessage)
 }
 
+// runPaymentHooks runs the hooks of a payment that has been received. The payment is already recorded,
+// a failing hook doesn't undo it.
+func runPaymentHooks(loanPayment LoanPayment) {
+	for _, hook := range paymentHooks {
+		if err := hook(loanPayment); err != nil {
+			log.Println("Error running payment hook:", err)
+		}
+	}
+}
+
+// settlementPending marks the response to an entry that was recorded but couldn't be allocated yet. The
+// loan is settled again with every later entry, or on demand through assess_fees.
+func settlementPending(response map[string]interface{}, loanSubmitID int, err error) {
+	log.Printf("Error settling loan submission %d: %v", loanSubmitID, err)
+	response["settlement_status"] = "pending"
+	response["settlement_error"] = fmt.Sprintf("The entry has been recorded but loan submission %d could not be settled, settle it again through assess_fees", loanSubmitID)
+}
+
 func UpdateLoanPayment(w http.ResponseWriter, r *http.Request) {
 	db, err := connectLoanPaymentsDB()
 	if err != nil {
@@ -327,15 +541,100 @@ func UpdateLoanPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reversed payments and compensating entries are never rewritten
+	if locked, err := isPaymentLocked(db, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if locked {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Loan payment %d is part of a reversal or refund and cannot be changed", id)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Remember the payment as it was before the update
+	var previous LoanPayment
+	err = scanLoanPayment(db.QueryRow("SELECT "+loanPaymentColumns+" FROM loan_payments WHERE loanPayment_id = $1", id), &previous)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	previousLoanSubmitID := previous.LoanSubmitID
+
+	// A written-off loan stands as it did when it was written off, so its payments are kept as they were
+	if status, err := checkNotWrittenOff(previousLoanSubmitID, "changed"); err != nil {
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Money moved onto a written-off loan is a recovery, like money received on it
+	loanSubmit, err := Loan_Submits.FindLoanSubmit(updateLoanPayment.LoanSubmitID)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_submits data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	updateLoanPayment.PaymentType = "payment"
+	if loanSubmit.LoanStatus == "written_off" {
+		updateLoanPayment.PaymentType = "recovery"
+	}
+
+	// The payer stays unless another is given, and must be liable for the loan the payment ends up on
+	if updateLoanPayment.PayerID == 0 {
+		updateLoanPayment.PayerID = previous.PayerID
+	}
+	if updateLoanPayment.PayerID == 0 {
+		updateLoanPayment.PayerID = loanSubmit.ApplicantID
+	}
+	if status, err := checkPayer(updateLoanPayment.LoanSubmitID, updateLoanPayment.PayerID); err != nil {
+		if status == http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Both loans stay locked until the payment has moved, see lockLoan
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	lockIDs := []int{previousLoanSubmitID, updateLoanPayment.LoanSubmitID}
+	sort.Ints(lockIDs)
+	for i, loanSubmitID := range lockIDs {
+		if i > 0 && loanSubmitID == lockIDs[i-1] {
+			continue
+		}
+		if err := lockLoan(tx, loanSubmitID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Update query
 	query := `UPDATE loan_payments 
-			  SET loanSubmit_id = $1, payment_amount = $2, payment_date = $3, payment_method = $4, payment_status = $5, updated_at = CURRENT_TIMESTAMP
+			  SET loanSubmit_id = $1, payment_amount = $2, payment_date = $3, payment_method = $4, payment_status = $5, payment_type = $7, payer_id = $8, updated_at = CURRENT_TIMESTAMP
               WHERE loanPayment_id = $6`
 
 	// Format time.Time to PostgreSQL DATE format
 	paymentDate := updateLoanPayment.PaymentDate.Format("2006-01-02")
 
-	result, err := db.Exec(query, updateLoanPayment.LoanSubmitID, updateLoanPayment.PaymentAmount, paymentDate, updateLoanPayment.PaymentMethod, updateLoanPayment.PaymentStatus, id)
+	result, err := tx.Exec(query, updateLoanPayment.LoanSubmitID, updateLoanPayment.PaymentAmount, paymentDate, updateLoanPayment.PaymentMethod, updateLoanPayment.PaymentStatus, id, updateLoanPayment.PaymentType, updateLoanPayment.PayerID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -351,6 +650,34 @@ func UpdateLoanPayment(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(errorResponse)
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Reallocate the payments of every loan affected by the update
+	for _, loanSubmitID := range []int{previousLoanSubmitID, updateLoanPayment.LoanSubmitID} {
+		if _, err := SettleLoan(loanSubmitID, time.Now()); err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if previousLoanSubmitID == updateLoanPayment.LoanSubmitID {
+			break
+		}
+	}
+
+	// Completing a payment is when its money is received
+	if previous.PaymentStatus != "completed" && updateLoanPayment.PaymentStatus == "completed" {
+		received := previous
+		received.LoanSubmitID = updateLoanPayment.LoanSubmitID
+		received.PaymentAmount = updateLoanPayment.PaymentAmount
+		received.PaymentDate = updateLoanPayment.PaymentDate
+		received.PaymentMethod = updateLoanPayment.PaymentMethod
+		received.PaymentStatus = updateLoanPayment.PaymentStatus
+		received.PaymentType = updateLoanPayment.PaymentType
+		received.PayerID = updateLoanPayment.PayerID
+		runPaymentHooks(received)
+	}
 
 	// Return success message
 	w.WriteHeader(http.StatusOK)
@@ -374,9 +701,49 @@ func DeleteLoanPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reversed payments and compensating entries are never rewritten
+	if locked, err := isPaymentLocked(db, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if locked {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Loan payment %d is part of a reversal or refund and cannot be deleted", id)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Remember which loan the payment belonged to
+	loanSubmitID, err := findPaymentLoanSubmitID(db, id)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A written-off loan stands as it did when it was written off, so its payments are kept as they were
+	if status, err := checkNotWrittenOff(loanSubmitID, "deleted"); err != nil {
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// The loan stays locked until the payment is gone, see lockLoan
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := lockLoan(tx, loanSubmitID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Delete query
 	query := `DELETE FROM loan_payments WHERE loanPayment_id = $1`
-	result, err := db.Exec(query, id)
+	result, err := tx.Exec(query, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -396,9 +763,55 @@ func DeleteLoanPayment(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(errorResponse)
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Reallocate the remaining payments of the loan
+	if _, err := SettleLoan(loanSubmitID, time.Now()); err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Return success message
 	w.WriteHeader(http.StatusOK)
 	successMessage := map[string]string{"message": fmt.Sprintf("Loan payment with ID %d deleted successfully", id)}
 	json.NewEncoder(w).Encode(successMessage)
 }
+
+// checkPayer returns a 422 Unprocessable Entity error when the payer of a payment isn't a party of the
+// loan submit it is paid on
+func checkPayer(loanSubmitID int, payerID int) (int, error) {
+	parties, err := Loan_Submits.FindLoanParties(loanSubmitID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for _, party := range parties {
+		if party.ApplicantID == payerID {
+			return http.StatusOK, nil
+		}
+	}
+	return http.StatusUnprocessableEntity, fmt.Errorf("Applicant %d is not a party of loan submission %d", payerID, loanSubmitID)
+}
+
+// checkNotWrittenOff returns a 409 Conflict error when the loan submit a payment belongs to has been
+// written off
+func checkNotWrittenOff(loanSubmitID int, action string) (int, error) {
+	loanSubmit, err := Loan_Submits.FindLoanSubmit(loanSubmitID)
+	if err == sql.ErrNoRows {
+		return http.StatusOK, nil
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if loanSubmit.LoanStatus == "written_off" {
+		return http.StatusConflict, fmt.Errorf("Loan submission %d has been written off, its payments can no longer be %s", loanSubmitID, action)
+	}
+	return http.StatusOK, nil
+}
+
+func findPaymentLoanSubmitID(db *sql.DB, id int) (int, error) {
+	var loanSubmitID int
+	err := db.QueryRow(`SELECT loanSubmit_id FROM loan_payments WHERE loanPayment_id = $1`, id).Scan(&loanSubmitID)
+	return loanSubmitID, err
+}
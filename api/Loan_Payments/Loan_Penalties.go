@@ -0,0 +1,283 @@
+package Loan_Payments
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Calendars"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+)
+
+// PenaltyPolicy controls the charges raised when an installment is still unpaid after its grace period.
+// FlatFee and OverduePercent (of the overdue amount) are charged once as a late fee, while PenaltyRate
+// is an annual rate accrued daily on the overdue principal until it is paid. GraceDays are business days
+// of HolidayCalendar counted from the first business day on or after the due date, or calendar days
+// when no calendar is set.
+type PenaltyPolicy struct {
+	GraceDays       int
+	FlatFee         decimal.Decimal
+	OverduePercent  decimal.Decimal
+	PenaltyRate     decimal.Decimal
+	HolidayCalendar string
+	calendar        Calendars.Calendar
+}
+
+var penaltyPolicy PenaltyPolicy
+
+func createLoanFeeTables(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS loan_fees (
+		loanFee_id SERIAL PRIMARY KEY,
+		loanSubmit_id INT NOT NULL,
+		installment_no INT NOT NULL,
+		fee_type VARCHAR(20) NOT NULL,
+		fee_amount DECIMAL(15, 2) NOT NULL,
+		paid_amount DECIMAL(15, 2) NOT NULL DEFAULT 0,
+		assessed_date DATE NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("error creating loan_fees table: %v", err)
+	}
+
+	// Fee types allowed, replaced whenever a new type is introduced
+	queries := []string{
+		`ALTER TABLE loan_fees DROP CONSTRAINT IF EXISTS loan_fees_fee_type_check`,
+		`ALTER TABLE loan_fees ADD CONSTRAINT loan_fees_fee_type_check CHECK (fee_type IN ('origination_fee', 'late_fee', 'penalty_interest', 'prepayment_penalty'))`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("error altering loan_fees table: %v", err)
+		}
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS payment_allocations (
+		allocation_id SERIAL PRIMARY KEY,
+		loanPayment_id INT NOT NULL,
+		loanSubmit_id INT NOT NULL,
+		installment_no INT NOT NULL,
+		component VARCHAR(15) NOT NULL CHECK (component IN ('fee', 'interest', 'principal')),
+		loanFee_id INT,
+		allocated_amount DECIMAL(15, 2) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("error creating payment_allocations table: %v", err)
+	}
+	return nil
+}
+
+func readPenaltyPolicyFromFile(filename string) (PenaltyPolicy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return PenaltyPolicy{}, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var policy PenaltyPolicy
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&policy); err != nil {
+		return PenaltyPolicy{}, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	if policy.GraceDays < 0 || policy.FlatFee.IsNegative() || policy.OverduePercent.IsNegative() || policy.PenaltyRate.IsNegative() {
+		return PenaltyPolicy{}, fmt.Errorf("invalid penalty policy: values must not be negative")
+	}
+	if policy.HolidayCalendar != "" {
+		if _, err := Calendars.LoadCalendar(policy.HolidayCalendar); err != nil {
+			return PenaltyPolicy{}, fmt.Errorf("invalid penalty policy: %v", err)
+		}
+	}
+
+	return policy, nil
+}
+
+// productTerms returns the penalty policy and upfront fees of a loan submit. The terms of the loan
+// product it was granted under decide the grace period and holiday calendar and may replace the late
+// fee of the penalty policy and charge an origination fee. Loans granted before products were
+// introduced follow the penalty policy alone.
+func productTerms(loanSubmit Loan_Submits.LoanSubmit) (PenaltyPolicy, []LoanFee, error) {
+	policy := penaltyPolicy
+	if loanSubmit.ProductID == 0 {
+		return policy, nil, policy.loadCalendar()
+	}
+
+	product, err := Loan_Submits.LoanProductTerms(loanSubmit)
+	if err != nil {
+		return PenaltyPolicy{}, nil, err
+	}
+
+	policy.GraceDays = product.GracePeriodDays
+	if product.HolidayCalendar != "" {
+		policy.HolidayCalendar = product.HolidayCalendar
+	}
+	if err := policy.loadCalendar(); err != nil {
+		return PenaltyPolicy{}, nil, err
+	}
+	if lateFee, ok := product.Fee("late_fee"); ok {
+		policy.FlatFee = lateFee.FlatAmount
+		policy.OverduePercent = lateFee.Percent
+	}
+
+	var fees []LoanFee
+	if originationFee, ok := product.Fee("origination_fee"); ok {
+		settlement := LoanSettlement{LoanSubmitID: loanSubmit.LoanSubmitID}
+		addFee(&settlement, 1, "origination_fee", originationFee.Amount(loanSubmit.LoanAmount), truncateToDay(loanSubmit.LoanDate.Time))
+		fees = settlement.Fees
+	}
+	return policy, fees, nil
+}
+
+// LoanCalendar returns the holiday calendar that decides when an installment of a loan submit is late.
+// It is empty when neither the loan product nor the penalty policy names a calendar.
+func LoanCalendar(loanSubmit Loan_Submits.LoanSubmit) (Calendars.Calendar, error) {
+	policy, _, err := productTerms(loanSubmit)
+	return policy.calendar, err
+}
+
+// loadCalendar reads the holiday calendar the grace period is counted in, if the policy has one
+func (policy *PenaltyPolicy) loadCalendar() error {
+	if policy.HolidayCalendar == "" {
+		return nil
+	}
+	calendar, err := Calendars.LoadCalendar(policy.HolidayCalendar)
+	if err != nil {
+		return fmt.Errorf("error loading holiday calendar: %v", err)
+	}
+	policy.calendar = calendar
+	return nil
+}
+
+// OverdueFrom returns the first day an installment due on the given date is overdue, the day after the
+// last business day of its grace period in the calendar as known on its due date
+func (policy PenaltyPolicy) OverdueFrom(dueDate time.Time) time.Time {
+	calendar := policy.calendar.AsOf(dueDate)
+	lastDay := calendar.Adjust(dueDate, Calendars.ConventionFollowing)
+	return calendar.AddBusinessDays(lastDay, policy.GraceDays).AddDate(0, 0, 1)
+}
+
+// assessPenalties raises the late fee of every installment that became overdue on the given date and
+// accrues penalty interest on overdue principal up to that date
+func assessPenalties(settlement *LoanSettlement, states []*installmentState, policy PenaltyPolicy, date time.Time) {
+	for _, state := range states {
+		if date.Before(state.overdueFrom) {
+			continue
+		}
+
+		overduePrincipal := state.PrincipalDue.Sub(state.PrincipalPaid)
+		overdueInterest := state.InterestDue.Sub(state.InterestPaid)
+
+		if !state.lateFeeAssessed {
+			state.lateFeeAssessed = true
+			state.penaltyAccruedTo = state.overdueFrom
+
+			overdue := overduePrincipal.Add(overdueInterest)
+			if overdue.IsPositive() {
+				amount := policy.FlatFee.Add(overdue.Mul(policy.OverduePercent).Div(decimal.NewFromInt(100))).Round(2)
+				addFee(settlement, state.InstallmentNo, "late_fee", amount, state.overdueFrom)
+			}
+		}
+
+		days := int(date.Sub(state.penaltyAccruedTo).Hours() / 24)
+		if days > 0 && overduePrincipal.IsPositive() {
+			amount := overduePrincipal.
+				Mul(policy.PenaltyRate).
+				Div(decimal.NewFromInt(100)).
+				Mul(decimal.NewFromInt(int64(days))).
+				Div(decimal.NewFromInt(365)).
+				Round(2)
+			addFee(settlement, state.InstallmentNo, "penalty_interest", amount, date)
+		}
+		state.penaltyAccruedTo = date
+	}
+}
+
+func addFee(settlement *LoanSettlement, installmentNo int, feeType string, amount decimal.Decimal, assessedDate time.Time) {
+	if !amount.IsPositive() {
+		return
+	}
+	settlement.Fees = append(settlement.Fees, LoanFee{
+		LoanSubmitID:  settlement.LoanSubmitID,
+		InstallmentNo: installmentNo,
+		FeeType:       feeType,
+		FeeAmount:     amount,
+		PaidAmount:    decimal.Zero,
+		AssessedDate:  CustomDate{Time: assessedDate},
+	})
+}
+
+func GetLoanFees(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLoanPaymentsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Extract loanSubmit_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Loan Submit ID", http.StatusBadRequest)
+		return
+	}
+
+	// Query from the loan_fees table
+	rows, err := db.Query(`SELECT loanFee_id, loanSubmit_id, installment_no, fee_type, fee_amount, paid_amount, assessed_date, created_at
+		FROM loan_fees WHERE loanSubmit_id = $1 ORDER BY assessed_date, loanFee_id`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var loanFees []LoanFee
+	for rows.Next() {
+		var fee LoanFee
+		if err := rows.Scan(&fee.LoanFeeID, &fee.LoanSubmitID, &fee.InstallmentNo, &fee.FeeType, &fee.FeeAmount, &fee.PaidAmount, &fee.AssessedDate, &fee.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		loanFees = append(loanFees, fee)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loanFees)
+}
+
+func AssessLoanFees(w http.ResponseWriter, r *http.Request) {
+	// Extract loanSubmit_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Loan Submit ID", http.StatusBadRequest)
+		return
+	}
+
+	// Replay the payments of the loan as of today to raise any outstanding penalties
+	settlement, err := SettleLoan(id, time.Now())
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_submits data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settlement)
+}
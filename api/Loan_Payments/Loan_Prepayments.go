@@ -0,0 +1,185 @@
+package Loan_Payments
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+)
+
+// PrepaymentPolicy decides what happens to the part of a payment exceeding what is currently due.
+// 'reduce_term' prepays the last installments first so the loan ends earlier, 'reduce_installment'
+// spreads the prepayment over every remaining installment, 'hold_credit' keeps the excess as a credit
+// balance that is used as installments fall due, and 'reject' refuses such payments altogether.
+// PenaltyPercent of the prepaid principal is charged as a prepayment penalty. Anything beyond the
+// whole outstanding balance is an overpayment and is held as credit balance that can be refunded.
+type PrepaymentPolicy struct {
+	Policy         string
+	PenaltyPercent decimal.Decimal
+}
+
+var prepaymentPolicy PrepaymentPolicy
+
+func readPrepaymentPolicyFromFile(filename string) (PrepaymentPolicy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return PrepaymentPolicy{}, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var policy PrepaymentPolicy
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&policy); err != nil {
+		return PrepaymentPolicy{}, fmt.Errorf("error decoding JSON: %v", err)
+	}
+
+	switch policy.Policy {
+	case "reduce_term", "reduce_installment", "hold_credit", "reject":
+	default:
+		return PrepaymentPolicy{}, fmt.Errorf("invalid prepayment policy '%s'. Allowed values are 'reduce_term', 'reduce_installment', 'hold_credit' or 'reject'", policy.Policy)
+	}
+	if policy.PenaltyPercent.IsNegative() {
+		return PrepaymentPolicy{}, fmt.Errorf("invalid prepayment policy: penalty percent must not be negative")
+	}
+
+	return policy, nil
+}
+
+func (policy PrepaymentPolicy) allowsPrepayment() bool {
+	return policy.Policy == "reduce_term" || policy.Policy == "reduce_installment"
+}
+
+// findPaymentSummary returns how the given payment was treated in a settlement
+func findPaymentSummary(settlement LoanSettlement, loanPaymentID int) PaymentSummary {
+	for _, summary := range settlement.Payments {
+		if summary.LoanPaymentID == loanPaymentID {
+			return summary
+		}
+	}
+	return PaymentSummary{LoanPaymentID: loanPaymentID, AppliedToDue: decimal.Zero, PrepaidPrincipal: decimal.Zero, PrepaymentPenalty: decimal.Zero, HeldAsCredit: decimal.Zero}
+}
+
+// prepay uses an amount for principal that isn't due yet, charging the prepayment penalty out of the
+// same amount, and recalculates the interest of the remaining installments on the reduced principal.
+// It returns the principal prepaid and the penalty charged.
+func (run *allocationRun) prepay(loanPaymentID int, loanSubmitID int, amount decimal.Decimal, date time.Time) (decimal.Decimal, decimal.Decimal) {
+	var future []*installmentState
+	futurePrincipal := decimal.Zero
+	for _, state := range run.states {
+		if state.DueDate.After(date) {
+			future = append(future, state)
+			futurePrincipal = futurePrincipal.Add(state.PrincipalDue.Sub(state.PrincipalPaid))
+		}
+	}
+	if !futurePrincipal.IsPositive() {
+		return decimal.Zero, decimal.Zero
+	}
+
+	// Split the amount so that the prepaid principal plus its penalty don't exceed it
+	rate := run.prepayment.PenaltyPercent.Div(decimal.NewFromInt(100))
+	prepaid := decimal.Min(futurePrincipal, amount.Div(decimal.NewFromInt(1).Add(rate)).RoundDown(2))
+	penalty := prepaid.Mul(rate).Round(2)
+	if prepaid.Add(penalty).GreaterThan(amount) {
+		penalty = amount.Sub(prepaid)
+	}
+
+	if penalty.IsPositive() {
+		addFee(&run.settlement, future[0].InstallmentNo, "prepayment_penalty", penalty, date)
+		feeIndex := len(run.settlement.Fees) - 1
+		fee := &run.settlement.Fees[feeIndex]
+		fee.PaidAmount = run.allocate(loanPaymentID, loanSubmitID, fee.InstallmentNo, "fee", feeIndex, &amount, penalty)
+	}
+
+	// Work out how much principal each remaining installment gets
+	shares := make([]decimal.Decimal, len(future))
+	switch run.prepayment.Policy {
+	case "reduce_term":
+		left := prepaid
+		for i := len(future) - 1; i >= 0; i-- {
+			shares[i] = decimal.Min(left, future[i].PrincipalDue.Sub(future[i].PrincipalPaid))
+			left = left.Sub(shares[i])
+		}
+	case "reduce_installment":
+		left := prepaid
+		for i, state := range future {
+			outstanding := state.PrincipalDue.Sub(state.PrincipalPaid)
+			if i == len(future)-1 {
+				shares[i] = decimal.Min(left, outstanding)
+			} else {
+				shares[i] = decimal.Min(left, prepaid.Mul(outstanding).Div(futurePrincipal).Round(2))
+			}
+			left = left.Sub(shares[i])
+		}
+	}
+
+	for i, state := range future {
+		paid := run.allocate(loanPaymentID, loanSubmitID, state.InstallmentNo, "principal", -1, &amount, shares[i])
+		state.PrincipalPaid = state.PrincipalPaid.Add(paid)
+		reduceFutureInterest(future[:i+1], paid, date)
+	}
+	return prepaid, penalty
+}
+
+// reduceFutureInterest lowers the interest of the given installments for principal repaid on the given
+// date. Principal of the last installment is outstanding during every period up to its due date, so
+// each of those periods accrues less interest from the repayment date onwards.
+func reduceFutureInterest(states []*installmentState, principal decimal.Decimal, date time.Time) {
+	if !principal.IsPositive() {
+		return
+	}
+	for _, state := range states {
+		from := truncateToDay(state.PeriodStart.Time)
+		if date.After(from) {
+			from = date
+		}
+		days := int(truncateToDay(state.DueDate.Time).Sub(from).Hours() / 24)
+		if days <= 0 {
+			continue
+		}
+
+		saving := principal.
+			Mul(state.InterestRate).
+			Div(decimal.NewFromInt(100)).
+			Mul(decimal.NewFromInt(int64(days))).
+			Div(decimal.NewFromInt(365)).
+			Round(2)
+		state.InterestDue = decimal.Max(state.InterestDue.Sub(saving), state.InterestPaid)
+	}
+}
+
+func GetRemainingSchedule(w http.ResponseWriter, r *http.Request) {
+	// Extract loanSubmit_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Loan Submit ID", http.StatusBadRequest)
+		return
+	}
+
+	// Replay the payments of the loan as of today without storing anything
+	settlement, _, err := EvaluateLoan(id, time.Now())
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_submits data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"loanSubmit_id":  id,
+		"installments":   settlement.Installments,
+		"credit_balance": settlement.Unapplied,
+	})
+}
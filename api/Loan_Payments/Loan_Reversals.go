@@ -0,0 +1,289 @@
+package Loan_Payments
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// isPaymentLocked reports whether a loan payment is part of a reversal or refund. Such records are kept
+// exactly as they were entered and can only be corrected with a further compensating entry.
+func isPaymentLocked(db *sql.DB, id int) (bool, error) {
+	var locked bool
+	query := `SELECT payment_type <> 'payment' OR EXISTS (SELECT 1 FROM loan_payments WHERE reversal_of = $1)
+		FROM loan_payments WHERE loanPayment_id = $1`
+	err := db.QueryRow(query, id).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return locked, err
+}
+
+// lockLoan serializes the entries that change the payments of a loan until the transaction ends, so that
+// a refund is never checked against a credit balance another entry is about to change. Every path that
+// records, changes or removes a payment takes it.
+func lockLoan(tx *sql.Tx, loanSubmitID int) error {
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", loanSubmitID); err != nil {
+		return fmt.Errorf("error locking loan submission %d: %v", loanSubmitID, err)
+	}
+	return nil
+}
+
+func ReverseLoanPayment(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLoanPaymentsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Extract loanPayment_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Loan Payment ID", http.StatusBadRequest)
+		return
+	}
+
+	// Query database for the payment being reversed
+	var original LoanPayment
+	query := "SELECT " + loanPaymentColumns + " FROM loan_payments WHERE loanPayment_id = $1"
+	err = scanLoanPayment(db.QueryRow(query, id), &original)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_payments data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if original.PaymentType != "payment" && original.PaymentType != "recovery" {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Loan payment %d is a %s and cannot be reversed", id, original.PaymentType)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	if original.PaymentStatus != "completed" {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Loan payment %d has not been completed, there is nothing to reverse", id)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Insert the compensating entry, leaving the original payment untouched
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := lockLoan(tx, original.LoanSubmitID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	query = `INSERT INTO loan_payments (loanSubmit_id, payment_amount, payment_date, payment_method, payment_status, payment_type, reversal_of, payer_id)
+        VALUES ($1, $2, $3, $4, 'completed', 'reversal', $5, NULLIF($6, 0)) RETURNING loanPayment_id`
+
+	var reversalID int
+	reversalDate := time.Now().Format("2006-01-02")
+	err = tx.QueryRow(query, original.LoanSubmitID, original.PaymentAmount.Neg(), reversalDate, original.PaymentMethod, id, original.PayerID).Scan(&reversalID)
+	if err != nil {
+		pgErr, ok := err.(*pq.Error)
+		if ok && pgErr.Code.Name() == "unique_violation" {
+			errorResponse := map[string]string{"error": fmt.Sprintf("Loan payment %d has already been reversed", id)}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+			json.NewEncoder(w).Encode(errorResponse)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Prepare success message
+	successMessage := map[string]interface{}{
+		"message":        fmt.Sprintf("Loan payment with ID %d reversed successfully", id),
+		"loanPayment_id": reversalID,
+		"reversal_of":    id,
+	}
+
+	// Reallocate the remaining payments of the loan and restore its balance and status. The reversal is
+	// recorded whatever happens, see CreateLoanPayment.
+	settlement, err := SettleLoan(original.LoanSubmitID, time.Now())
+	if err != nil {
+		settlementPending(successMessage, original.LoanSubmitID, err)
+	} else {
+		successMessage["settlement_status"] = "settled"
+		successMessage["outstanding_principal"] = settlement.OutstandingPrincipal
+		successMessage["credit_balance"] = settlement.Unapplied
+	}
+
+	// Set Content-Type and return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated) // HTTP 201 Created
+	json.NewEncoder(w).Encode(successMessage)
+}
+
+func RefundCreditBalance(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLoanPaymentsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Extract loanSubmit_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Loan Submit ID", http.StatusBadRequest)
+		return
+	}
+
+	// Parse JSON request body
+	var refund LoanPayment
+	err = json.NewDecoder(r.Body).Decode(&refund)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !refund.PaymentAmount.IsPositive() {
+		errorResponse := map[string]string{"error": "Refund amount must be greater than zero"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+	today := truncateToDay(time.Now())
+	if refund.PaymentDate.IsZero() {
+		refund.PaymentDate = CustomDate{Time: today}
+	}
+	if refund.PaymentDate.After(today) {
+		errorResponse := map[string]string{"error": "Refund date cannot be in the future"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Only money the borrower overpaid can be refunded. The loan stays locked from the check until the
+	// refund is recorded, so concurrent refunds can't both spend the same credit balance.
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := lockLoan(tx, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	settlement, err := SettleLoan(id, time.Now())
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_submits data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The refund is replayed on its own date, so it can't come before the credit it pays back
+	creditDate, err := latestCreditDate(db, settlement)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if refund.PaymentDate.Before(creditDate) {
+		errorResponse := map[string]string{
+			"error": fmt.Sprintf("Refund date cannot be before %s, when the credit balance was paid", creditDate.Format("2006-01-02")),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+	if refund.PaymentAmount.GreaterThan(settlement.Unapplied) {
+		errorResponse := map[string]string{
+			"error": fmt.Sprintf("Refund of %s exceeds the credit balance of %s", refund.PaymentAmount.StringFixed(2), settlement.Unapplied.StringFixed(2)),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Record the refund as money leaving the loan
+	query := `INSERT INTO loan_payments (loanSubmit_id, payment_amount, payment_date, payment_method, payment_status, payment_type)
+        VALUES ($1, $2, $3, $4, 'completed', 'refund') RETURNING loanPayment_id`
+
+	var refundID int
+	err = tx.QueryRow(query, id, refund.PaymentAmount.Neg(), refund.PaymentDate.Format("2006-01-02"), refund.PaymentMethod).Scan(&refundID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Prepare success message
+	successMessage := map[string]interface{}{
+		"message":        fmt.Sprintf("Refund of %s recorded for loan submission %d", refund.PaymentAmount.StringFixed(2), id),
+		"loanPayment_id": refundID,
+	}
+
+	// The refund is recorded whatever happens, see CreateLoanPayment
+	settlement, err = SettleLoan(id, time.Now())
+	if err != nil {
+		settlementPending(successMessage, id, err)
+	} else {
+		successMessage["settlement_status"] = "settled"
+		successMessage["credit_balance"] = settlement.Unapplied
+	}
+
+	// Set Content-Type and return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated) // HTTP 201 Created
+	json.NewEncoder(w).Encode(successMessage)
+}
+
+// latestCreditDate returns the date of the latest payment of a settlement that left money held as credit
+func latestCreditDate(db *sql.DB, settlement LoanSettlement) (time.Time, error) {
+	payments, err := loadLoanPayments(db, settlement.LoanSubmitID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	held := make(map[int]bool)
+	for _, summary := range settlement.Payments {
+		if summary.HeldAsCredit.IsPositive() {
+			held[summary.LoanPaymentID] = true
+		}
+	}
+	var latest time.Time
+	for _, payment := range payments {
+		if held[payment.LoanPaymentID] && payment.PaymentDate.After(latest) {
+			latest = truncateToDay(payment.PaymentDate.Time)
+		}
+	}
+	return latest, nil
+}
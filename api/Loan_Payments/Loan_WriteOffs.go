@@ -0,0 +1,222 @@
+package Loan_Payments
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/General_Ledger"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// LoanWriteOff takes a loan that will not be repaid off the books. The principal and accrued interest
+// still receivable are charged to bad debt expense, the outstanding fees were never booked as income
+// and are only recorded. Money received on the loan afterwards is a recovery, RecoveredAmount is the
+// total recovered so far.
+type LoanWriteOff struct {
+	WriteOffID      int
+	LoanSubmitID    int
+	WriteOffDate    CustomDate
+	ReasonCode      string
+	ApprovedBy      string
+	Notes           string
+	PrincipalAmount decimal.Decimal
+	InterestAmount  decimal.Decimal
+	FeeAmount       decimal.Decimal
+	RecoveredAmount decimal.Decimal
+	CreatedAt       string
+}
+
+func createWriteOffTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS loan_write_offs (
+		writeOff_id SERIAL PRIMARY KEY,
+		loanSubmit_id INT NOT NULL UNIQUE,
+		write_off_date DATE NOT NULL,
+		reason_code VARCHAR(20) NOT NULL CHECK (reason_code IN ('uncollectible', 'deceased', 'bankruptcy', 'fraud', 'settlement')),
+		approved_by VARCHAR(50) NOT NULL,
+		notes TEXT NOT NULL DEFAULT '',
+		principal_amount DECIMAL(15, 2) NOT NULL,
+		interest_amount DECIMAL(15, 2) NOT NULL,
+		fee_amount DECIMAL(15, 2) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("error creating loan_write_offs table: %v", err)
+	}
+	return nil
+}
+
+// findWriteOff looks up the write-off of a loan submit together with what has been recovered on it
+func findWriteOff(db *sql.DB, loanSubmitID int) (LoanWriteOff, error) {
+	var writeOff LoanWriteOff
+	query := `SELECT w.writeOff_id, w.loanSubmit_id, w.write_off_date, w.reason_code, w.approved_by, w.notes,
+			w.principal_amount, w.interest_amount, w.fee_amount, w.created_at,
+			COALESCE((SELECT SUM(p.payment_amount) FROM loan_payments p WHERE p.loanSubmit_id = w.loanSubmit_id AND p.payment_status = 'completed'
+				AND (p.payment_type = 'recovery' OR p.reversal_of IN (SELECT loanPayment_id FROM loan_payments WHERE payment_type = 'recovery'))), 0)
+		FROM loan_write_offs w WHERE w.loanSubmit_id = $1`
+	err := db.QueryRow(query, loanSubmitID).Scan(&writeOff.WriteOffID, &writeOff.LoanSubmitID, &writeOff.WriteOffDate, &writeOff.ReasonCode,
+		&writeOff.ApprovedBy, &writeOff.Notes, &writeOff.PrincipalAmount, &writeOff.InterestAmount, &writeOff.FeeAmount, &writeOff.CreatedAt,
+		&writeOff.RecoveredAmount)
+	return writeOff, err
+}
+
+func GetLoanWriteOff(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLoanPaymentsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Extract loanSubmit_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Loan Submit ID", http.StatusBadRequest)
+		return
+	}
+
+	writeOff, err := findWriteOff(db, id)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_write_offs data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(writeOff)
+}
+
+func WriteOffLoan(w http.ResponseWriter, r *http.Request) {
+	db, err := connectLoanPaymentsDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Extract loanSubmit_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Loan Submit ID", http.StatusBadRequest)
+		return
+	}
+
+	// Parse JSON request body, a loan is written off as it stands today
+	var writeOff LoanWriteOff
+	if err := json.NewDecoder(r.Body).Decode(&writeOff); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeOff.LoanSubmitID = id
+	writeOff.WriteOffDate = CustomDate{Time: truncateToDay(time.Now())}
+
+	var validationError string
+	switch {
+	case writeOff.ReasonCode != "uncollectible" && writeOff.ReasonCode != "deceased" && writeOff.ReasonCode != "bankruptcy" && writeOff.ReasonCode != "fraud" && writeOff.ReasonCode != "settlement":
+		validationError = "Invalid ReasonCode. Allowed values are 'uncollectible', 'deceased', 'bankruptcy', 'fraud' or 'settlement'"
+	case writeOff.ApprovedBy == "":
+		validationError = "ApprovedBy is required"
+	}
+	if validationError != "" {
+		errorResponse := map[string]string{"error": validationError}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Only an ongoing loan can be written off
+	loanSubmit, err := Loan_Submits.FindLoanSubmit(id)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_submits data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if loanSubmit.LoanStatus != "ongoing" {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Loan submission %d is %s, only ongoing loans can be written off", id, loanSubmit.LoanStatus)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Bring the interest receivable and the fees of the loan up to date before taking them off the books
+	if _, err := AccrueLoanInterest(loanSubmit, writeOff.WriteOffDate.Time); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	settlement, err := SettleLoan(id, writeOff.WriteOffDate.Time)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeOff.FeeAmount = settlement.OutstandingFees
+	if writeOff.PrincipalAmount, err = General_Ledger.LoanBalance(id, General_Ledger.LoanReceivableAccount); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if writeOff.InterestAmount, err = General_Ledger.LoanBalance(id, General_Ledger.InterestReceivableAccount); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Record the write-off, a loan can only be written off once
+	query := `INSERT INTO loan_write_offs (loanSubmit_id, write_off_date, reason_code, approved_by, notes, principal_amount, interest_amount, fee_amount)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING writeOff_id, created_at`
+	err = db.QueryRow(query, id, writeOff.WriteOffDate, writeOff.ReasonCode, writeOff.ApprovedBy, writeOff.Notes,
+		writeOff.PrincipalAmount, writeOff.InterestAmount, writeOff.FeeAmount).Scan(&writeOff.WriteOffID, &writeOff.CreatedAt)
+	if err != nil {
+		pgErr, ok := err.(*pq.Error)
+		if ok && pgErr.Code.Name() == "unique_violation" {
+			errorResponse := map[string]string{"error": fmt.Sprintf("Loan submission %d has already been written off", id)}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+			json.NewEncoder(w).Encode(errorResponse)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeOff.RecoveredAmount = decimal.Zero
+
+	// Charge the principal and interest receivable to bad debt expense
+	lines := []General_Ledger.JournalLine{
+		{AccountCode: General_Ledger.BadDebtExpenseAccount, Debit: writeOff.PrincipalAmount.Add(writeOff.InterestAmount), Credit: decimal.Zero},
+		{AccountCode: General_Ledger.LoanReceivableAccount, Debit: decimal.Zero, Credit: writeOff.PrincipalAmount},
+		{AccountCode: General_Ledger.InterestReceivableAccount, Debit: decimal.Zero, Credit: writeOff.InterestAmount},
+	}
+	description := fmt.Sprintf("Write-off of loan submit %d (%s)", id, writeOff.ReasonCode)
+	if err := General_Ledger.SyncJournal(General_Ledger.SourceWriteOff, writeOff.WriteOffID, id, writeOff.WriteOffDate.Time, description, lines); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := Loan_Submits.MarkWrittenOff(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Set Content-Type and return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated) // HTTP 201 Created
+	json.NewEncoder(w).Encode(writeOff)
+}
@@ -0,0 +1,287 @@
+package Loan_Restructures
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Payments"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Products"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+)
+
+// RestructureRequest asks for the terms of a loan submit to be changed from today. InterestRate is
+// left unchanged when it is omitted.
+type RestructureRequest struct {
+	LoanSubmitID      int
+	ExtendMonths      int
+	HolidayMonths     int
+	InterestRate      *decimal.Decimal
+	CapitalizeArrears bool
+	Reason            string
+}
+
+func CreateLoanRestructure(w http.ResponseWriter, r *http.Request) {
+	// Parse JSON request body
+	var request RestructureRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Validate the requested changes
+	var validationError string
+	switch {
+	case request.ExtendMonths < 0 || request.HolidayMonths < 0:
+		validationError = "ExtendMonths and HolidayMonths must not be negative"
+	case request.InterestRate != nil && (request.InterestRate.IsNegative() || request.InterestRate.GreaterThanOrEqual(decimal.NewFromInt(1000))):
+		validationError = "InterestRate must be between 0 and 999.99"
+	case request.ExtendMonths == 0 && request.HolidayMonths == 0 && request.InterestRate == nil && !request.CapitalizeArrears:
+		validationError = "Nothing to restructure. Provide ExtendMonths, HolidayMonths, InterestRate or CapitalizeArrears"
+	case request.Reason == "":
+		validationError = "Reason is required"
+	}
+	if validationError != "" {
+		errorResponse := map[string]string{"error": validationError}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	loanSubmit, versions, err := Loan_Submits.GetLoanSchedule(request.LoanSubmitID)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_submits data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if loanSubmit.LoanStatus != "ongoing" {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Loan submission %d is %s, only ongoing loans can be restructured", request.LoanSubmitID, loanSubmit.LoanStatus)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	restructure, settlement, err := restructureLoan(loanSubmit, versions, request, "restructure", truncateToDay(time.Now()))
+	if err == errNothingToReschedule {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Loan submission %d has no installments left to reschedule. Capitalize its arrears and extend its term to restructure it", request.LoanSubmitID)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err == Loan_Submits.ErrScheduleChanged {
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Prepare success message
+	successMessage := map[string]interface{}{
+		"message":          fmt.Sprintf("Loan submission with ID %d restructured successfully", request.LoanSubmitID),
+		"restructure_id":   restructure.RestructureID,
+		"schedule_version": restructure.ToVersion,
+		"restructure":      restructure,
+		"installments":     settlement.Installments,
+	}
+
+	// Set Content-Type and return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated) // HTTP 201 Created
+	json.NewEncoder(w).Encode(successMessage)
+}
+
+// errNothingToReschedule is returned when every installment has fallen due and the restructure
+// doesn't capitalize the arrears into a later one
+var errNothingToReschedule = errors.New("no installments left to reschedule")
+
+// restructureLoan adds a schedule version to a loan submit taking effect on the given date, stores it
+// with the restructure that produced it and reallocates the payments of the loan on the new schedule
+func restructureLoan(loanSubmit Loan_Submits.LoanSubmit, versions []Loan_Submits.ScheduleVersion, request RestructureRequest, restructureType string, effectiveDate time.Time) (Loan_Submits.LoanRestructure, Loan_Payments.LoanSettlement, error) {
+	// Work out where the loan stands on the day the restructure takes effect
+	before, err := Loan_Payments.EvaluateSchedule(loanSubmit, versions, effectiveDate)
+	if err != nil {
+		return Loan_Submits.LoanRestructure{}, Loan_Payments.LoanSettlement{}, err
+	}
+
+	restructure := Loan_Submits.LoanRestructure{
+		LoanSubmitID:         loanSubmit.LoanSubmitID,
+		RestructureType:      restructureType,
+		FromVersion:          versions[len(versions)-1].ScheduleVersion,
+		EffectiveDate:        Loan_Submits.CustomDate{Time: effectiveDate},
+		InterestRate:         loanSubmit.InterestRate,
+		ExtendMonths:         request.ExtendMonths,
+		HolidayMonths:        request.HolidayMonths,
+		CapitalizeArrears:    request.CapitalizeArrears,
+		CapitalizedPrincipal: decimal.Zero,
+		CapitalizedInterest:  decimal.Zero,
+		Reason:               request.Reason,
+	}
+	if request.InterestRate != nil {
+		restructure.InterestRate = request.InterestRate.Round(2)
+	}
+
+	// Installments already due stay on the schedule, the rest are moved by the payment holiday and the
+	// last one by the term extension
+	var installments []Loan_Submits.Installment
+	var dueDates []time.Time
+	lastInstallmentNo := 0
+	for _, balance := range before.Installments {
+		if balance.DueDate.After(effectiveDate) {
+			dueDates = append(dueDates, Loan_Products.AddMonths(balance.DueDate.Time, request.HolidayMonths))
+			continue
+		}
+		installments = append(installments, Loan_Submits.Installment{
+			InstallmentNo: balance.InstallmentNo,
+			PeriodStart:   balance.PeriodStart,
+			DueDate:       balance.DueDate,
+			PrincipalDue:  balance.PrincipalDue,
+			InterestDue:   balance.InterestDue,
+			InterestRate:  balance.InterestRate,
+		})
+		if balance.InstallmentNo > lastInstallmentNo {
+			lastInstallmentNo = balance.InstallmentNo
+		}
+		if request.CapitalizeArrears {
+			restructure.CapitalizedPrincipal = restructure.CapitalizedPrincipal.Add(balance.PrincipalDue.Sub(balance.PrincipalPaid))
+			restructure.CapitalizedInterest = restructure.CapitalizedInterest.Add(balance.InterestDue.Sub(balance.InterestPaid))
+		}
+	}
+	sort.Slice(dueDates, func(i, j int) bool { return dueDates[i].Before(dueDates[j]) })
+
+	if len(dueDates) == 0 {
+		// Every installment has fallen due, so the arrears are all that is left to reschedule
+		months := request.HolidayMonths + request.ExtendMonths
+		if !request.CapitalizeArrears || months == 0 {
+			return Loan_Submits.LoanRestructure{}, Loan_Payments.LoanSettlement{}, errNothingToReschedule
+		}
+		dueDates = append(dueDates, Loan_Products.AddMonths(effectiveDate, months))
+	} else {
+		dueDates[len(dueDates)-1] = Loan_Products.AddMonths(dueDates[len(dueDates)-1], request.ExtendMonths)
+	}
+
+	// Moved due dates fall on business days like the original ones
+	if loanSubmit.ProductID != 0 {
+		product, err := Loan_Submits.LoanProductTerms(loanSubmit)
+		if err != nil {
+			return Loan_Submits.LoanRestructure{}, Loan_Payments.LoanSettlement{}, err
+		}
+		if dueDates, err = product.AdjustDates(dueDates); err != nil {
+			return Loan_Submits.LoanRestructure{}, Loan_Payments.LoanSettlement{}, err
+		}
+	}
+	for i, dueDate := range dueDates {
+		installments = append(installments, Loan_Submits.Installment{
+			InstallmentNo: lastInstallmentNo + i + 1,
+			DueDate:       Loan_Submits.CustomDate{Time: dueDate},
+			InterestRate:  restructure.InterestRate,
+		})
+	}
+
+	// Replay the loan on the new version to get the amounts of the rescheduled installments
+	candidate := Loan_Submits.ScheduleVersion{
+		ScheduleVersion:   restructure.FromVersion + 1,
+		EffectiveDate:     restructure.EffectiveDate,
+		InterestRate:      restructure.InterestRate,
+		CapitalizeArrears: request.CapitalizeArrears,
+		Installments:      installments,
+	}
+	after, err := Loan_Payments.EvaluateSchedule(loanSubmit, append(versions, candidate), effectiveDate)
+	if err != nil {
+		return Loan_Submits.LoanRestructure{}, Loan_Payments.LoanSettlement{}, err
+	}
+
+	var schedule []Loan_Submits.Installment
+	for _, balance := range after.Installments {
+		schedule = append(schedule, Loan_Submits.Installment{
+			InstallmentNo: balance.InstallmentNo,
+			PeriodStart:   balance.PeriodStart,
+			DueDate:       balance.DueDate,
+			PrincipalDue:  balance.PrincipalDue,
+			InterestDue:   balance.InterestDue,
+			InterestRate:  balance.InterestRate,
+		})
+	}
+
+	if err := Loan_Submits.SaveLoanRestructure(&restructure, schedule); err != nil {
+		return Loan_Submits.LoanRestructure{}, Loan_Payments.LoanSettlement{}, err
+	}
+
+	// Reallocate the payments of the loan on its new schedule
+	settlement, err := Loan_Payments.SettleLoan(loanSubmit.LoanSubmitID, time.Now())
+	if err != nil {
+		return Loan_Submits.LoanRestructure{}, Loan_Payments.LoanSettlement{}, err
+	}
+	return restructure, settlement, nil
+}
+
+func GetLoanRestructures(w http.ResponseWriter, r *http.Request) {
+	// Extract loanSubmit_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Loan Submit ID", http.StatusBadRequest)
+		return
+	}
+
+	restructures, err := Loan_Submits.ListLoanRestructures(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restructures)
+}
+
+func GetScheduleVersions(w http.ResponseWriter, r *http.Request) {
+	// Extract loanSubmit_id from request parameters
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid Loan Submit ID", http.StatusBadRequest)
+		return
+	}
+
+	_, versions, err := Loan_Submits.GetLoanSchedule(id)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "loan_submits data not found"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"loanSubmit_id": id,
+		"versions":      versions,
+	})
+}
+
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
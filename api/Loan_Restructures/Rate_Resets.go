@@ -0,0 +1,168 @@
+package Loan_Restructures
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/SupachotT/Loan_Management_System.git/api/Reference_Rates"
+)
+
+// applyRateResets resets the interest rate of a variable-rate loan on every reset date up to the given
+// date that the schedule hasn't caught up with yet. Each reset that changes the rate adds a schedule
+// version taking effect on the reset date, recalculating the interest of the remaining installments.
+// Earlier versions are never rewritten, so when the schedule has already moved past the latest reset
+// date, because of a later restructure or because the index value was corrected after the reset, the
+// rate of that reset is applied from the latest version onwards instead. It returns the resets made.
+func applyRateResets(loanSubmit Loan_Submits.LoanSubmit, asOf time.Time) ([]Loan_Submits.LoanRestructure, error) {
+	if loanSubmit.ProductID == 0 {
+		return nil, nil
+	}
+	product, err := Loan_Submits.LoanProductTerms(loanSubmit)
+	if err != nil {
+		return nil, err
+	}
+	if product.RateType != "variable" {
+		return nil, nil
+	}
+
+	var resetDates []time.Time
+	for _, resetDate := range product.ResetDates(loanSubmit.LoanDate.Time, loanSubmit.DueDate.Time) {
+		if !resetDate.After(asOf) {
+			resetDates = append(resetDates, resetDate)
+		}
+	}
+
+	var resets []Loan_Submits.LoanRestructure
+	for i, resetDate := range resetDates {
+		loanSubmit, versions, err := Loan_Submits.GetLoanSchedule(loanSubmit.LoanSubmitID)
+		if err != nil {
+			return resets, err
+		}
+		latest := versions[len(versions)-1]
+		effectiveDate := resetDate
+		if !resetDate.After(latest.EffectiveDate.Time) {
+			// A later reset sets the rate from its own date, only the latest one is caught up with
+			if i < len(resetDates)-1 {
+				continue
+			}
+			effectiveDate = truncateToDay(latest.EffectiveDate.Time)
+		}
+
+		indexRate, err := Reference_Rates.RateOn(product.ReferenceIndex, resetDate)
+		if err != nil {
+			return resets, err
+		}
+		rate := product.ClampRate(indexRate.Add(loanSubmit.RateMargin))
+		if rate.Equal(latest.InterestRate) {
+			continue
+		}
+
+		request := RestructureRequest{
+			LoanSubmitID: loanSubmit.LoanSubmitID,
+			InterestRate: &rate,
+			Reason: fmt.Sprintf("Rate reset of %s to %s%% (%s %s%% + margin %s%%)", resetDate.Format("2006-01-02"), rate.StringFixed(2),
+				product.ReferenceIndex, indexRate.StringFixed(2), loanSubmit.RateMargin.StringFixed(2)),
+		}
+		restructure, _, err := restructureLoan(loanSubmit, versions, request, "rate_reset", effectiveDate)
+		if err == errNothingToReschedule {
+			continue
+		} else if err != nil {
+			return resets, err
+		}
+		resets = append(resets, restructure)
+	}
+	return resets, nil
+}
+
+// resetLoans applies the rate resets of the ongoing loans up to the given date, for the given reference
+// indexes only when any are given. A loan that can't be reset doesn't hold up the others, its error is
+// returned with the resets made.
+func resetLoans(asOf time.Time, indexes map[string]bool) ([]Loan_Submits.LoanRestructure, []error, error) {
+	loanSubmits, err := Loan_Submits.ListLoanSubmits("ongoing")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var resets []Loan_Submits.LoanRestructure
+	var loanErrors []error
+	for _, loanSubmit := range loanSubmits {
+		if len(indexes) > 0 {
+			product, err := Loan_Submits.LoanProductTerms(loanSubmit)
+			if err != nil {
+				loanErrors = append(loanErrors, fmt.Errorf("loan submit %d: %v", loanSubmit.LoanSubmitID, err))
+				continue
+			}
+			if !indexes[product.ReferenceIndex] {
+				continue
+			}
+		}
+		loanResets, err := applyRateResets(loanSubmit, asOf)
+		resets = append(resets, loanResets...)
+		if err != nil {
+			log.Printf("Error resetting the rate of loan submit %d: %v", loanSubmit.LoanSubmitID, err)
+			loanErrors = append(loanErrors, fmt.Errorf("loan submit %d: %v", loanSubmit.LoanSubmitID, err))
+		}
+	}
+	return resets, loanErrors, nil
+}
+
+// ResetRatesNightly applies the rate resets that have fallen due before the nightly delinquency job
+func ResetRatesNightly(asOf time.Time) error {
+	resets, loanErrors, err := resetLoans(asOf, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rate reset job applied %d interest rate resets", len(resets))
+	if len(loanErrors) > 0 {
+		return fmt.Errorf("%d loan submits could not be reset, the first: %v", len(loanErrors), loanErrors[0])
+	}
+	return nil
+}
+
+// RecalculateRates applies the rate resets of the loans following reference indexes whose values have
+// just been loaded or corrected
+func RecalculateRates(changed map[string]time.Time) error {
+	indexes := make(map[string]bool)
+	for indexName := range changed {
+		indexes[indexName] = true
+	}
+	resets, loanErrors, err := resetLoans(truncateToDay(time.Now()), indexes)
+	if err != nil {
+		return err
+	}
+	log.Printf("Reference rate changes applied %d interest rate resets", len(resets))
+	if len(loanErrors) > 0 {
+		return fmt.Errorf("%d loan submits could not be reset, the first: %v", len(loanErrors), loanErrors[0])
+	}
+	return nil
+}
+
+func ResetInterestRates(w http.ResponseWriter, r *http.Request) {
+	// Reset the rate of every ongoing variable-rate loan up to today
+	asOf := truncateToDay(time.Now())
+	resets, loanErrors, err := resetLoans(asOf, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"message": fmt.Sprintf("%d interest rate resets applied up to %s", len(resets), asOf.Format("2006-01-02")),
+		"resets":  resets,
+	}
+	if len(loanErrors) > 0 {
+		var messages []string
+		for _, err := range loanErrors {
+			messages = append(messages, err.Error())
+		}
+		response["errors"] = messages
+	}
+
+	// Return JSON response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
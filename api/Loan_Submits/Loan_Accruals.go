@@ -0,0 +1,80 @@
+package Loan_Submits
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/General_Ledger"
+	"github.com/shopspring/decimal"
+)
+
+// postDisbursement books the loan amount paid out to the borrower
+func postDisbursement(loanSubmit LoanSubmit) error {
+	lines := []General_Ledger.JournalLine{
+		{AccountCode: General_Ledger.LoanReceivableAccount, Debit: loanSubmit.LoanAmount, Credit: decimal.Zero},
+		{AccountCode: General_Ledger.CashAccount, Debit: decimal.Zero, Credit: loanSubmit.LoanAmount},
+	}
+	description := fmt.Sprintf("Disbursement of loan submit %d", loanSubmit.LoanSubmitID)
+	return General_Ledger.SyncJournal(General_Ledger.SourceDisbursement, loanSubmit.LoanSubmitID, loanSubmit.LoanSubmitID, loanSubmit.LoanDate.Time, description, lines)
+}
+
+// reverseLoanJournals reverses the disbursement and interest accrued for a loan submit that has been removed
+func reverseLoanJournals(id int) error {
+	description := fmt.Sprintf("Reversal of deleted loan submit %d", id)
+	if err := General_Ledger.SyncJournal(General_Ledger.SourceDisbursement, id, id, time.Now(), description, nil); err != nil {
+		return err
+	}
+	return General_Ledger.SyncJournal(General_Ledger.SourceAccrual, id, id, time.Now(), description, nil)
+}
+
+// PostInterestAccrual books the interest earned on a loan submit up to the given date, replacing what
+// was booked before
+func PostInterestAccrual(loanSubmitID int, accrued decimal.Decimal, asOf time.Time) error {
+	lines := []General_Ledger.JournalLine{
+		{AccountCode: General_Ledger.InterestReceivableAccount, Debit: accrued, Credit: decimal.Zero},
+		{AccountCode: General_Ledger.InterestIncomeAccount, Debit: decimal.Zero, Credit: accrued},
+	}
+	description := fmt.Sprintf("Interest accrued on loan submit %d up to %s", loanSubmitID, asOf.Format("2006-01-02"))
+	return General_Ledger.SyncJournal(General_Ledger.SourceAccrual, loanSubmitID, loanSubmitID, asOf, description, lines)
+}
+
+// CapitalizedInterest returns the interest capitalized by restructures of a loan submit up to the given
+// date. It was earned all the same, even though it is no longer on the schedule.
+func CapitalizedInterest(loanSubmitID int, asOf time.Time) (decimal.Decimal, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return decimal.Zero, err
+	}
+	defer db.Close()
+	return capitalizedInterest(db, loanSubmitID, asOf)
+}
+
+// AccruedInterest returns the interest earned on a schedule up to the given date. The interest of each
+// installment accrues evenly from the previous due date (or LoanDate for the first installment) to its
+// own due date.
+func AccruedInterest(loanSubmit LoanSubmit, schedule []Installment, asOf time.Time) decimal.Decimal {
+	asOf = truncateToDay(asOf)
+	accrued := decimal.Zero
+	periodStart := truncateToDay(loanSubmit.LoanDate.Time)
+	for _, installment := range schedule {
+		periodEnd := truncateToDay(installment.DueDate.Time)
+		periodDays := periodEnd.Sub(periodStart).Hours() / 24
+		elapsedDays := asOf.Sub(periodStart).Hours() / 24
+
+		switch {
+		case !asOf.Before(periodEnd) || periodDays <= 0:
+			accrued = accrued.Add(installment.InterestDue)
+		case elapsedDays > 0:
+			accrued = accrued.Add(installment.InterestDue.
+				Mul(decimal.NewFromFloat(elapsedDays)).
+				Div(decimal.NewFromFloat(periodDays)).
+				Round(2))
+		}
+
+		if asOf.Before(periodEnd) {
+			break
+		}
+		periodStart = periodEnd
+	}
+	return accrued
+}
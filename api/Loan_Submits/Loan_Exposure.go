@@ -0,0 +1,167 @@
+package Loan_Submits
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/shopspring/decimal"
+)
+
+// ExposureLimits cap how much an applicant may owe at once: the number of ongoing loans and the
+// principal outstanding on them, overall and per loan product. A limit of zero isn't enforced.
+type ExposureLimits struct {
+	MaxOngoingLoans         int
+	MaxOutstandingPrincipal decimal.Decimal
+	ProductLimits           []ProductExposureLimit
+}
+
+// ProductExposureLimit caps the ongoing loans of an applicant under one loan product
+type ProductExposureLimit struct {
+	ProductID               int
+	MaxOngoingLoans         int
+	MaxOutstandingPrincipal decimal.Decimal
+}
+
+// Exposure is what an applicant owes on the ongoing loans they are a party of, overall and per loan
+// product. A loan counts in full for its borrowers, a guarantor owes only the guaranteed share of its
+// principal and doesn't count it among their ongoing loans.
+type Exposure struct {
+	ApplicantID          int
+	OngoingLoans         int
+	OutstandingPrincipal decimal.Decimal
+	Products             []ProductExposure
+}
+
+// ProductExposure is what an applicant owes on their ongoing loans under one loan product
+type ProductExposure struct {
+	ProductID            int
+	OngoingLoans         int
+	OutstandingPrincipal decimal.Decimal
+}
+
+// ExposureLimitError is returned by SubmitLoan when granting the loan would take the applicant over
+// one of the exposure limits. Exposure is what the applicant owed before the loan.
+type ExposureLimitError struct {
+	Limit    string
+	Message  string
+	Exposure Exposure
+}
+
+func (err *ExposureLimitError) Error() string {
+	return err.Message
+}
+
+var exposureLimits ExposureLimits
+
+func readExposureLimitsFromFile(filename string) (ExposureLimits, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return ExposureLimits{}, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var limits ExposureLimits
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&limits); err != nil {
+		return ExposureLimits{}, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	if limits.MaxOngoingLoans < 0 || limits.MaxOutstandingPrincipal.IsNegative() {
+		return ExposureLimits{}, fmt.Errorf("invalid exposure limits: limits must not be negative")
+	}
+	for _, limit := range limits.ProductLimits {
+		if limit.ProductID <= 0 || limit.MaxOngoingLoans < 0 || limit.MaxOutstandingPrincipal.IsNegative() {
+			return ExposureLimits{}, fmt.Errorf("invalid exposure limits of loan product %d", limit.ProductID)
+		}
+	}
+	return limits, nil
+}
+
+// ApplicantExposure adds up the ongoing loans an applicant is a party of
+func ApplicantExposure(applicantID int) (Exposure, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return Exposure{}, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Exposure{}, err
+	}
+	defer tx.Rollback()
+	return currentExposure(tx, applicantID, 0)
+}
+
+// currentExposure adds up the ongoing loans an applicant is a party of, leaving out the given loan
+// submit when one that already exists is checked again
+func currentExposure(tx *sql.Tx, applicantID int, excludeLoanSubmitID int) (Exposure, error) {
+	exposure := Exposure{ApplicantID: applicantID, Products: []ProductExposure{}}
+	query := `SELECT COALESCE(l.product_id, 0), COUNT(*) FILTER (WHERE p.party_role <> 'guarantor'),
+			ROUND(SUM(CASE WHEN p.party_role = 'guarantor' THEN l.outstanding_balance * p.guaranteed_share / 100 ELSE l.outstanding_balance END), 2)
+		FROM loan_submits l JOIN loan_parties p ON p.loanSubmit_id = l.loanSubmit_id
+		WHERE p.applicant_id = $1 AND l.loan_status = 'ongoing' AND l.loanSubmit_id <> $2 GROUP BY COALESCE(l.product_id, 0) ORDER BY 1`
+	rows, err := tx.Query(query, applicantID, excludeLoanSubmitID)
+	if err != nil {
+		return Exposure{}, fmt.Errorf("error querying exposure of applicant %d: %v", applicantID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var product ProductExposure
+		if err := rows.Scan(&product.ProductID, &product.OngoingLoans, &product.OutstandingPrincipal); err != nil {
+			return Exposure{}, err
+		}
+		exposure.OngoingLoans += product.OngoingLoans
+		exposure.OutstandingPrincipal = exposure.OutstandingPrincipal.Add(product.OutstandingPrincipal)
+		exposure.Products = append(exposure.Products, product)
+	}
+	return exposure, rows.Err()
+}
+
+// checkExposure returns an ExposureLimitError if granting the loan submit would take one of its parties
+// over an exposure limit, or nil if it wouldn't
+func checkExposure(exposure Exposure, party LoanParty, loanSubmit LoanSubmit) error {
+	breach := func(limit string, format string, args ...interface{}) error {
+		return &ExposureLimitError{Limit: limit, Message: fmt.Sprintf(format, args...), Exposure: exposure}
+	}
+
+	// What the party takes on with the new loan
+	loans, principal := 1, loanSubmit.LoanAmount
+	if party.PartyRole == "guarantor" {
+		loans, principal = 0, loanSubmit.LoanAmount.Mul(party.GuaranteedShare).Div(decimal.NewFromInt(100)).Round(2)
+	}
+
+	if exposureLimits.MaxOngoingLoans > 0 && loans > 0 && exposure.OngoingLoans+loans > exposureLimits.MaxOngoingLoans {
+		return breach("MaxOngoingLoans", "Applicant %d already has %d ongoing loans, the most allowed is %d",
+			party.ApplicantID, exposure.OngoingLoans, exposureLimits.MaxOngoingLoans)
+	}
+	total := exposure.OutstandingPrincipal.Add(principal)
+	if exposureLimits.MaxOutstandingPrincipal.IsPositive() && total.GreaterThan(exposureLimits.MaxOutstandingPrincipal) {
+		return breach("MaxOutstandingPrincipal", "Applicant %d would owe %s in principal, the most allowed is %s",
+			party.ApplicantID, total.StringFixed(2), exposureLimits.MaxOutstandingPrincipal.StringFixed(2))
+	}
+
+	for _, limit := range exposureLimits.ProductLimits {
+		if limit.ProductID != loanSubmit.ProductID {
+			continue
+		}
+		var product ProductExposure
+		for _, p := range exposure.Products {
+			if p.ProductID == limit.ProductID {
+				product = p
+			}
+		}
+		if limit.MaxOngoingLoans > 0 && loans > 0 && product.OngoingLoans+loans > limit.MaxOngoingLoans {
+			return breach("ProductMaxOngoingLoans", "Applicant %d already has %d ongoing loans under loan product %d, the most allowed is %d",
+				party.ApplicantID, product.OngoingLoans, limit.ProductID, limit.MaxOngoingLoans)
+		}
+		total := product.OutstandingPrincipal.Add(principal)
+		if limit.MaxOutstandingPrincipal.IsPositive() && total.GreaterThan(limit.MaxOutstandingPrincipal) {
+			return breach("ProductMaxOutstandingPrincipal", "Applicant %d would owe %s in principal under loan product %d, the most allowed is %s",
+				party.ApplicantID, total.StringFixed(2), limit.ProductID, limit.MaxOutstandingPrincipal.StringFixed(2))
+		}
+	}
+	return nil
+}
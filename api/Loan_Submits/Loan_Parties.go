@@ -0,0 +1,237 @@
+package Loan_Submits
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Applicants"
+	"github.com/shopspring/decimal"
+)
+
+// LoanParty is an applicant liable for a loan submit. The 'primary' borrower is the ApplicantID of the
+// loan, a 'co_borrower' is jointly liable for all of it and a 'guarantor' for the GuaranteedShare
+// percent of it.
+type LoanParty struct {
+	LoanSubmitID    int
+	ApplicantID     int
+	PartyRole       string
+	GuaranteedShare decimal.Decimal
+	CreatedAt       string
+}
+
+func createLoanPartyTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS loan_parties (
+		loanParty_id SERIAL PRIMARY KEY,
+		loanSubmit_id INT NOT NULL REFERENCES loan_submits (loanSubmit_id) ON DELETE CASCADE,
+		applicant_id INT NOT NULL,
+		party_role VARCHAR(15) NOT NULL CHECK (party_role IN ('primary', 'co_borrower', 'guarantor')),
+		guaranteed_share DECIMAL(5, 2) NOT NULL DEFAULT 0 CHECK (guaranteed_share BETWEEN 0 AND 100),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (loanSubmit_id, applicant_id)
+	)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("error creating loan_parties table: %v", err)
+	}
+	return nil
+}
+
+// addPrimaryParties records the applicant of every loan submit without parties as its primary borrower
+func addPrimaryParties(db *sql.DB) error {
+	query := `INSERT INTO loan_parties (loanSubmit_id, applicant_id, party_role)
+		SELECT l.loanSubmit_id, l.applicant_id, 'primary' FROM loan_submits l
+		WHERE NOT EXISTS (SELECT 1 FROM loan_parties p WHERE p.loanSubmit_id = l.loanSubmit_id)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("error adding primary borrowers to loan_parties: %v", err)
+	}
+	return nil
+}
+
+// validateLoanParties checks the parties of a new loan submit besides its primary borrower and returns
+// the HTTP status to answer with when they don't fit
+func validateLoanParties(loanSubmit LoanSubmit) (int, error) {
+	seen := map[int]bool{loanSubmit.ApplicantID: true}
+	for _, party := range loanSubmit.Parties {
+		switch {
+		case party.PartyRole != "co_borrower" && party.PartyRole != "guarantor":
+			return http.StatusBadRequest, fmt.Errorf("Invalid PartyRole: '%s'. Allowed values are 'co_borrower' or 'guarantor', the primary borrower is the ApplicantID", party.PartyRole)
+		case party.PartyRole == "guarantor" && (!party.GuaranteedShare.IsPositive() || party.GuaranteedShare.GreaterThan(decimal.NewFromInt(100))):
+			return http.StatusBadRequest, fmt.Errorf("GuaranteedShare of guarantor %d must be more than 0 and at most 100 percent", party.ApplicantID)
+		case party.PartyRole == "co_borrower" && !party.GuaranteedShare.IsZero():
+			return http.StatusBadRequest, fmt.Errorf("GuaranteedShare only applies to guarantors")
+		case seen[party.ApplicantID]:
+			return http.StatusBadRequest, fmt.Errorf("applicant %d is named more than once as a party of the loan", party.ApplicantID)
+		}
+		seen[party.ApplicantID] = true
+
+		if _, err := Loan_Applicants.FindApplicant(party.ApplicantID); err == sql.ErrNoRows {
+			return http.StatusBadRequest, fmt.Errorf("applicant %d not found", party.ApplicantID)
+		} else if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// allParties returns the primary borrower of a new loan submit followed by its other parties, with the
+// loan submit set on each
+func allParties(loanSubmit LoanSubmit) []LoanParty {
+	parties := []LoanParty{{LoanSubmitID: loanSubmit.LoanSubmitID, ApplicantID: loanSubmit.ApplicantID, PartyRole: "primary"}}
+	for _, party := range loanSubmit.Parties {
+		party.LoanSubmitID = loanSubmit.LoanSubmitID
+		parties = append(parties, party)
+	}
+	return parties
+}
+
+// lockParties takes the advisory lock of every party of a new loan submit, in applicant order so that
+// two loans sharing parties can't wait on each other
+func lockParties(tx *sql.Tx, parties []LoanParty) error {
+	var applicantIDs []int
+	for _, party := range parties {
+		applicantIDs = append(applicantIDs, party.ApplicantID)
+	}
+	sort.Ints(applicantIDs)
+	for _, applicantID := range applicantIDs {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", applicantID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertLoanParties(tx *sql.Tx, parties []LoanParty) error {
+	for _, party := range parties {
+		query := `INSERT INTO loan_parties (loanSubmit_id, applicant_id, party_role, guaranteed_share) VALUES ($1, $2, $3, $4)`
+		if _, err := tx.Exec(query, party.LoanSubmitID, party.ApplicantID, party.PartyRole, party.GuaranteedShare); err != nil {
+			return fmt.Errorf("error inserting loan party: %v", err)
+		}
+	}
+	return nil
+}
+
+// FindLoanParties returns the parties of a loan submit, the primary borrower first
+func FindLoanParties(loanSubmitID int) ([]LoanParty, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return loadLoanParties(db, loanSubmitID)
+}
+
+func loadLoanParties(db interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, loanSubmitID int) ([]LoanParty, error) {
+	query := `SELECT loanSubmit_id, applicant_id, party_role, guaranteed_share, created_at FROM loan_parties
+		WHERE loanSubmit_id = $1 ORDER BY party_role <> 'primary', loanParty_id`
+	rows, err := db.Query(query, loanSubmitID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying loan parties: %v", err)
+	}
+	defer rows.Close()
+
+	parties := []LoanParty{}
+	for rows.Next() {
+		var party LoanParty
+		if err := rows.Scan(&party.LoanSubmitID, &party.ApplicantID, &party.PartyRole, &party.GuaranteedShare, &party.CreatedAt); err != nil {
+			return nil, err
+		}
+		parties = append(parties, party)
+	}
+	return parties, rows.Err()
+}
+
+// SharedLoans returns the loan submits two applicants are both parties of
+func SharedLoans(applicantID int, otherApplicantID int) ([]int, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	query := `SELECT a.loanSubmit_id FROM loan_parties a JOIN loan_parties b ON b.loanSubmit_id = a.loanSubmit_id
+		WHERE a.applicant_id = $1 AND b.applicant_id = $2 ORDER BY a.loanSubmit_id`
+	rows, err := db.Query(query, applicantID, otherApplicantID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying shared loans: %v", err)
+	}
+	defer rows.Close()
+
+	var loanSubmitIDs []int
+	for rows.Next() {
+		var loanSubmitID int
+		if err := rows.Scan(&loanSubmitID); err != nil {
+			return nil, err
+		}
+		loanSubmitIDs = append(loanSubmitIDs, loanSubmitID)
+	}
+	return loanSubmitIDs, rows.Err()
+}
+
+// ReassignApplicant moves the loans of an applicant merged into another over to that applicant and
+// returns how many loans they were a party of. The two must not share a loan, see SharedLoans.
+func ReassignApplicant(fromID int, toID int) (int64, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockParties(tx, []LoanParty{{ApplicantID: fromID}, {ApplicantID: toID}}); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE loan_submits SET applicant_id = $2, updated_at = CURRENT_TIMESTAMP WHERE applicant_id = $1`, fromID, toID); err != nil {
+		return 0, fmt.Errorf("error reassigning loan submits of applicant %d: %v", fromID, err)
+	}
+	result, err := tx.Exec(`UPDATE loan_parties SET applicant_id = $2 WHERE applicant_id = $1`, fromID, toID)
+	if err != nil {
+		return 0, fmt.Errorf("error reassigning loan parties of applicant %d: %v", fromID, err)
+	}
+	loans, _ := result.RowsAffected()
+	return loans, tx.Commit()
+}
+
+// PartyLoan is a loan submit an applicant is a party of. A loan no longer ongoing was closed no later
+// than its UpdatedAt.
+type PartyLoan struct {
+	LoanSubmitID int
+	PartyRole    string
+	LoanStatus   string
+	UpdatedAt    time.Time
+}
+
+// ApplicantLoans returns the loan submits an applicant is a party of, in any role
+func ApplicantLoans(applicantID int) ([]PartyLoan, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	query := `SELECT l.loanSubmit_id, p.party_role, l.loan_status, l.updated_at FROM loan_parties p
+		JOIN loan_submits l ON l.loanSubmit_id = p.loanSubmit_id WHERE p.applicant_id = $1 ORDER BY l.loanSubmit_id`
+	rows, err := db.Query(query, applicantID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying loans of applicant %d: %v", applicantID, err)
+	}
+	defer rows.Close()
+
+	var loans []PartyLoan
+	for rows.Next() {
+		var loan PartyLoan
+		if err := rows.Scan(&loan.LoanSubmitID, &loan.PartyRole, &loan.LoanStatus, &loan.UpdatedAt); err != nil {
+			return nil, err
+		}
+		loans = append(loans, loan)
+	}
+	return loans, rows.Err()
+}
@@ -0,0 +1,222 @@
+package Loan_Submits
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/General_Ledger"
+	"github.com/shopspring/decimal"
+)
+
+// LoanRestructure records a change to the repayment terms of a loan submit. It links the schedule
+// version that was replaced (FromVersion) to the one that took over on EffectiveDate (ToVersion).
+// ExtendMonths moves the final due date out, HolidayMonths postpones every remaining installment and
+// InterestRate applies to the rescheduled installments. When CapitalizeArrears is set the principal
+// and interest overdue on EffectiveDate are added to the rescheduled principal. RestructureType is
+// 'rate_reset' for the periodic interest rate resets of variable-rate loans.
+type LoanRestructure struct {
+	RestructureID        int
+	LoanSubmitID         int
+	RestructureType      string
+	FromVersion          int
+	ToVersion            int
+	EffectiveDate        CustomDate
+	InterestRate         decimal.Decimal
+	ExtendMonths         int
+	HolidayMonths        int
+	CapitalizeArrears    bool
+	CapitalizedPrincipal decimal.Decimal
+	CapitalizedInterest  decimal.Decimal
+	Reason               string
+	CreatedAt            string
+}
+
+// ErrScheduleChanged is returned when a loan submit was restructured again while a restructure was being prepared
+var ErrScheduleChanged = errors.New("the schedule of the loan submit has changed, please try again")
+
+const loanRestructureColumns = `restructure_id, loanSubmit_id, restructure_type, from_version, to_version, effective_date, interest_rate, extend_months,
+	holiday_months, capitalize_arrears, capitalized_principal, capitalized_interest, reason, created_at`
+
+func scanLoanRestructure(row interface{ Scan(...interface{}) error }, restructure *LoanRestructure) error {
+	return row.Scan(&restructure.RestructureID, &restructure.LoanSubmitID, &restructure.RestructureType, &restructure.FromVersion, &restructure.ToVersion,
+		&restructure.EffectiveDate, &restructure.InterestRate, &restructure.ExtendMonths, &restructure.HolidayMonths,
+		&restructure.CapitalizeArrears, &restructure.CapitalizedPrincipal, &restructure.CapitalizedInterest, &restructure.Reason, &restructure.CreatedAt)
+}
+
+func createLoanScheduleTables(db *sql.DB) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS loan_schedules (
+			loanSchedule_id SERIAL PRIMARY KEY,
+			loanSubmit_id INT NOT NULL REFERENCES loan_submits (loanSubmit_id) ON DELETE CASCADE,
+			schedule_version INT NOT NULL,
+			installment_no INT NOT NULL,
+			period_start DATE NOT NULL,
+			due_date DATE NOT NULL,
+			principal_due DECIMAL(15, 2) NOT NULL,
+			interest_due DECIMAL(15, 2) NOT NULL,
+			interest_rate DECIMAL(5, 2) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (loanSubmit_id, schedule_version, installment_no)
+		)`,
+		`CREATE TABLE IF NOT EXISTS loan_restructures (
+			restructure_id SERIAL PRIMARY KEY,
+			loanSubmit_id INT NOT NULL REFERENCES loan_submits (loanSubmit_id) ON DELETE CASCADE,
+			from_version INT NOT NULL,
+			to_version INT NOT NULL,
+			effective_date DATE NOT NULL,
+			interest_rate DECIMAL(5, 2) NOT NULL,
+			extend_months INT NOT NULL DEFAULT 0 CHECK (extend_months >= 0),
+			holiday_months INT NOT NULL DEFAULT 0 CHECK (holiday_months >= 0),
+			capitalize_arrears BOOLEAN NOT NULL DEFAULT FALSE,
+			capitalized_principal DECIMAL(15, 2) NOT NULL DEFAULT 0,
+			capitalized_interest DECIMAL(15, 2) NOT NULL DEFAULT 0,
+			reason VARCHAR(200) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (loanSubmit_id, to_version)
+		)`,
+		`ALTER TABLE loan_restructures ADD COLUMN IF NOT EXISTS restructure_type VARCHAR(15) NOT NULL DEFAULT 'restructure'
+			CHECK (restructure_type IN ('restructure', 'rate_reset'))`,
+		// The terms of the loan product each loan submit was granted under
+		`CREATE TABLE IF NOT EXISTS loan_terms (
+			loanSubmit_id INT PRIMARY KEY REFERENCES loan_submits (loanSubmit_id) ON DELETE CASCADE,
+			product JSONB NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("error creating loan schedule tables: %v", err)
+		}
+	}
+	return nil
+}
+
+// SaveLoanRestructure stores a new schedule version of a loan submit together with the restructure that
+// produced it, keeping every earlier version. The terms on the loan submit itself are updated to the
+// new interest rate and final due date.
+func SaveLoanRestructure(restructure *LoanRestructure, installments []Installment) error {
+	if len(installments) == 0 {
+		return fmt.Errorf("error saving loan restructure: the new schedule has no installments")
+	}
+
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the loan so that two restructures can't both build on the same version
+	var loanSubmit LoanSubmit
+	query := "SELECT " + loanSubmitColumns + " FROM loan_submits WHERE loanSubmit_id = $1 FOR UPDATE"
+	if err := scanLoanSubmit(tx.QueryRow(query, restructure.LoanSubmitID), &loanSubmit); err != nil {
+		return err
+	}
+
+	var currentVersion int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(schedule_version), 0) FROM loan_schedules WHERE loanSubmit_id = $1`, restructure.LoanSubmitID).Scan(&currentVersion)
+	if err != nil {
+		return fmt.Errorf("error querying loan schedules: %v", err)
+	}
+
+	if currentVersion != restructure.FromVersion {
+		return ErrScheduleChanged
+	}
+
+	restructure.ToVersion = currentVersion + 1
+	if err := insertScheduleVersion(tx, restructure.LoanSubmitID, restructure.ToVersion, installments); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO loan_restructures (loanSubmit_id, restructure_type, from_version, to_version, effective_date, interest_rate, extend_months,
+			holiday_months, capitalize_arrears, capitalized_principal, capitalized_interest, reason)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING restructure_id, created_at`
+	err = tx.QueryRow(query, restructure.LoanSubmitID, restructure.RestructureType, restructure.FromVersion, restructure.ToVersion, restructure.EffectiveDate,
+		restructure.InterestRate, restructure.ExtendMonths, restructure.HolidayMonths, restructure.CapitalizeArrears,
+		restructure.CapitalizedPrincipal, restructure.CapitalizedInterest, restructure.Reason).Scan(&restructure.RestructureID, &restructure.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error inserting loan restructure: %v", err)
+	}
+
+	// The loan now runs until the last rescheduled installment
+	dueDate := installments[len(installments)-1].DueDate
+	query = `UPDATE loan_submits SET interest_rate = $2, due_date = $3, updated_at = CURRENT_TIMESTAMP WHERE loanSubmit_id = $1`
+	if _, err := tx.Exec(query, restructure.LoanSubmitID, restructure.InterestRate, dueDate); err != nil {
+		return fmt.Errorf("error updating loan submit terms: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return postCapitalization(*restructure)
+}
+
+func insertScheduleVersion(tx *sql.Tx, loanSubmitID int, version int, installments []Installment) error {
+	query := `INSERT INTO loan_schedules (loanSubmit_id, schedule_version, installment_no, period_start, due_date, principal_due, interest_due, interest_rate)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	for _, installment := range installments {
+		_, err := tx.Exec(query, loanSubmitID, version, installment.InstallmentNo, installment.PeriodStart, installment.DueDate,
+			installment.PrincipalDue, installment.InterestDue, installment.InterestRate)
+		if err != nil {
+			return fmt.Errorf("error inserting loan schedule: %v", err)
+		}
+	}
+	return nil
+}
+
+// postCapitalization books capitalized interest as part of the loan receivable. Capitalized principal
+// already is, so it needs no entry.
+func postCapitalization(restructure LoanRestructure) error {
+	if !restructure.CapitalizedInterest.IsPositive() {
+		return nil
+	}
+	lines := []General_Ledger.JournalLine{
+		{AccountCode: General_Ledger.LoanReceivableAccount, Debit: restructure.CapitalizedInterest, Credit: decimal.Zero},
+		{AccountCode: General_Ledger.InterestReceivableAccount, Debit: decimal.Zero, Credit: restructure.CapitalizedInterest},
+	}
+	description := fmt.Sprintf("Interest capitalized by restructure %d of loan submit %d", restructure.RestructureID, restructure.LoanSubmitID)
+	return General_Ledger.SyncJournal(General_Ledger.SourceRestructure, restructure.RestructureID, restructure.LoanSubmitID, restructure.EffectiveDate.Time, description, lines)
+}
+
+// ListLoanRestructures returns the restructures of a loan submit, oldest first
+func ListLoanRestructures(loanSubmitID int) ([]LoanRestructure, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT "+loanRestructureColumns+" FROM loan_restructures WHERE loanSubmit_id = $1 ORDER BY to_version", loanSubmitID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying loan restructures: %v", err)
+	}
+	defer rows.Close()
+
+	var restructures []LoanRestructure
+	for rows.Next() {
+		var restructure LoanRestructure
+		if err := scanLoanRestructure(rows, &restructure); err != nil {
+			return nil, err
+		}
+		restructures = append(restructures, restructure)
+	}
+	return restructures, rows.Err()
+}
+
+// capitalizedInterest returns the interest capitalized by restructures of a loan submit up to the given date
+func capitalizedInterest(db *sql.DB, loanSubmitID int, asOf time.Time) (decimal.Decimal, error) {
+	var capitalized decimal.Decimal
+	query := `SELECT COALESCE(SUM(capitalized_interest), 0) FROM loan_restructures WHERE loanSubmit_id = $1 AND effective_date <= $2`
+	if err := db.QueryRow(query, loanSubmitID, asOf.Format("2006-01-02")).Scan(&capitalized); err != nil {
+		return decimal.Zero, fmt.Errorf("error querying capitalized interest: %v", err)
+	}
+	return capitalized, nil
+}
@@ -0,0 +1,403 @@
+package Loan_Submits
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Products"
+	"github.com/shopspring/decimal"
+)
+
+// Installment is one amount falling due on the repayment schedule of a loan submit. InterestDue is
+// the annual InterestRate accrued on the principal outstanding between PeriodStart and DueDate.
+type Installment struct {
+	InstallmentNo int
+	PeriodStart   CustomDate
+	DueDate       CustomDate
+	PrincipalDue  decimal.Decimal
+	InterestDue   decimal.Decimal
+	InterestRate  decimal.Decimal
+}
+
+// FindLoanSubmit returns the loan submit with the given loanSubmit_id, or sql.ErrNoRows if it doesn't exist
+func FindLoanSubmit(id int) (LoanSubmit, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return LoanSubmit{}, err
+	}
+	defer db.Close()
+
+	var loanSubmit LoanSubmit
+	query := "SELECT " + loanSubmitColumns + " FROM loan_submits WHERE loanSubmit_id = $1"
+	err = scanLoanSubmit(db.QueryRow(query, id), &loanSubmit)
+	if err != nil {
+		return LoanSubmit{}, err
+	}
+	return loanSubmit, nil
+}
+
+// ListLoanSubmits returns every loan submit with the given loan_status, or all of them if it is empty
+func ListLoanSubmits(loanStatus string) ([]LoanSubmit, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	query := "SELECT " + loanSubmitColumns + " FROM loan_submits WHERE $1 = '' OR loan_status = $1 ORDER BY loanSubmit_id"
+	rows, err := db.Query(query, loanStatus)
+	if err != nil {
+		return nil, fmt.Errorf("error querying loan submits: %v", err)
+	}
+	defer rows.Close()
+
+	var loanSubmits []LoanSubmit
+	for rows.Next() {
+		var loanSubmit LoanSubmit
+		if err := scanLoanSubmit(rows, &loanSubmit); err != nil {
+			return nil, err
+		}
+		loanSubmits = append(loanSubmits, loanSubmit)
+	}
+	return loanSubmits, rows.Err()
+}
+
+// ScheduleVersion is one version of the repayment schedule of a loan submit. Version 1 is the schedule
+// the loan was granted with; every restructure adds a version that takes over from its EffectiveDate.
+// Installments falling due up to EffectiveDate are carried over from the previous version (reduced to
+// what had been paid when arrears were capitalized), the later ones are rescheduled at InterestRate.
+type ScheduleVersion struct {
+	ScheduleVersion   int
+	EffectiveDate     CustomDate
+	InterestRate      decimal.Decimal
+	CapitalizeArrears bool
+	Installments      []Installment
+}
+
+// GenerateInstallments spreads principal evenly over installments falling due on the given dates. The
+// interest of each installment accrues at the annual rate on the principal still outstanding during its
+// period, the first period starting on periodStart.
+func GenerateInstallments(principal decimal.Decimal, rate decimal.Decimal, periodStart time.Time, dueDates []time.Time, firstInstallmentNo int) []Installment {
+	var installments []Installment
+	outstanding := principal
+	periodStart = truncateToDay(periodStart)
+	for i, dueDate := range dueDates {
+		dueDate = truncateToDay(dueDate)
+		principalDue := principal.Div(decimal.NewFromInt(int64(len(dueDates)))).RoundDown(2)
+		if i == len(dueDates)-1 {
+			principalDue = outstanding
+		}
+
+		days := int(dueDate.Sub(periodStart).Hours() / 24)
+		if days < 0 {
+			days = 0
+		}
+		interest := outstanding.
+			Mul(rate).
+			Div(decimal.NewFromInt(100)).
+			Mul(decimal.NewFromInt(int64(days))).
+			Div(decimal.NewFromInt(365)).
+			Round(2)
+
+		installments = append(installments, Installment{
+			InstallmentNo: firstInstallmentNo + i,
+			PeriodStart:   CustomDate{Time: periodStart},
+			DueDate:       CustomDate{Time: dueDate},
+			PrincipalDue:  principalDue,
+			InterestDue:   interest,
+			InterestRate:  rate,
+		})
+		outstanding = outstanding.Sub(principalDue)
+		periodStart = dueDate
+	}
+	return installments
+}
+
+// BuildLoanSchedule returns the installments a loan submit is granted with, falling due at the
+// repayment frequency of its loan product. A loan submit without a product is repaid as a single
+// bullet installment on its DueDate.
+func BuildLoanSchedule(loanSubmit LoanSubmit, product Loan_Products.LoanProduct) ([]Installment, error) {
+	dueDates := []time.Time{loanSubmit.DueDate.Time}
+	if loanSubmit.ProductID != 0 {
+		var err error
+		dueDates, err = product.DueDates(truncateToDay(loanSubmit.LoanDate.Time), truncateToDay(loanSubmit.DueDate.Time))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return GenerateInstallments(loanSubmit.LoanAmount, loanSubmit.InterestRate, loanSubmit.LoanDate.Time, dueDates, 1), nil
+}
+
+// storeGrantedTerms stores the schedule a loan submit is granted with as schedule version 1, with the
+// terms of its loan product as they are now. Loans are only ever settled from what is stored, so a
+// later change to the product doesn't reach the loans already granted under it. A loan edited before
+// it was ever restructured has its terms stored anew.
+func storeGrantedTerms(tx *sql.Tx, loanSubmit LoanSubmit) error {
+	var product Loan_Products.LoanProduct
+	if loanSubmit.ProductID != 0 {
+		var err error
+		product, err = Loan_Products.FindLoanProduct(loanSubmit.ProductID)
+		if err != nil {
+			return fmt.Errorf("error finding loan product %d: %v", loanSubmit.ProductID, err)
+		}
+	}
+	installments, err := BuildLoanSchedule(loanSubmit, product)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM loan_schedules WHERE loanSubmit_id = $1 AND schedule_version = 1`, loanSubmit.LoanSubmitID); err != nil {
+		return fmt.Errorf("error replacing loan schedule: %v", err)
+	}
+	if err := insertScheduleVersion(tx, loanSubmit.LoanSubmitID, 1, installments); err != nil {
+		return err
+	}
+	return storeProductTerms(tx, loanSubmit, product)
+}
+
+// storeProductTerms keeps the terms of the loan product a loan submit is granted under
+func storeProductTerms(tx *sql.Tx, loanSubmit LoanSubmit, product Loan_Products.LoanProduct) error {
+	if _, err := tx.Exec(`DELETE FROM loan_terms WHERE loanSubmit_id = $1`, loanSubmit.LoanSubmitID); err != nil {
+		return fmt.Errorf("error replacing loan terms: %v", err)
+	}
+	if loanSubmit.ProductID == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(product)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO loan_terms (loanSubmit_id, product) VALUES ($1, $2)`, loanSubmit.LoanSubmitID, encoded); err != nil {
+		return fmt.Errorf("error inserting loan terms: %v", err)
+	}
+	return nil
+}
+
+// storeMissingTerms stores the granted schedule and product terms of loan submits created before they
+// were stored with the loan. Their terms are taken from the loan products as they are on the first
+// start, and kept from then on.
+func storeMissingTerms(db *sql.DB) error {
+	query := "SELECT " + loanSubmitColumns + `, EXISTS (SELECT 1 FROM loan_schedules s WHERE s.loanSubmit_id = l.loanSubmit_id) FROM loan_submits l
+		WHERE NOT EXISTS (SELECT 1 FROM loan_schedules s WHERE s.loanSubmit_id = l.loanSubmit_id)
+			OR (product_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM loan_terms t WHERE t.loanSubmit_id = l.loanSubmit_id))
+		ORDER BY loanSubmit_id`
+	rows, err := db.Query(query)
+	if err != nil {
+		return fmt.Errorf("error querying loan submits without stored terms: %v", err)
+	}
+	type missingTerms struct {
+		loanSubmit  LoanSubmit
+		hasSchedule bool
+	}
+	var missing []missingTerms
+	for rows.Next() {
+		var loan missingTerms
+		s := &loan.loanSubmit
+		err := rows.Scan(&s.LoanSubmitID, &s.ApplicantID, &s.ProductID, &s.LoanAmount, &s.InterestRate, &s.RateMargin,
+			&s.LoanDate, &s.DueDate, &s.LoanStatus, &s.OutstandingBalance, &s.CreatedAt, &s.UpdatedAt, &loan.hasSchedule)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		missing = append(missing, loan)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, loan := range missing {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if !loan.hasSchedule {
+			err = storeGrantedTerms(tx, loan.loanSubmit)
+		} else {
+			// A restructured loan keeps its stored versions, only the product terms are missing
+			var product Loan_Products.LoanProduct
+			product, err = Loan_Products.FindLoanProduct(loan.loanSubmit.ProductID)
+			if err == nil {
+				err = storeProductTerms(tx, loan.loanSubmit, product)
+			}
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		tx.Rollback()
+		if err != nil {
+			return fmt.Errorf("error storing the terms of loan submit %d: %v", loan.loanSubmit.LoanSubmitID, err)
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("Stored the granted terms of %d loan submits", len(missing))
+	}
+	return nil
+}
+
+// LoanProductTerms returns the terms of the loan product a loan submit was granted under, as they were
+// when it was granted. A loan submit without a product has a zero LoanProduct.
+func LoanProductTerms(loanSubmit LoanSubmit) (Loan_Products.LoanProduct, error) {
+	if loanSubmit.ProductID == 0 {
+		return Loan_Products.LoanProduct{}, nil
+	}
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return Loan_Products.LoanProduct{}, err
+	}
+	defer db.Close()
+
+	var encoded []byte
+	err = db.QueryRow(`SELECT product FROM loan_terms WHERE loanSubmit_id = $1`, loanSubmit.LoanSubmitID).Scan(&encoded)
+	if err == sql.ErrNoRows {
+		return Loan_Products.LoanProduct{}, fmt.Errorf("loan submit %d has no stored product terms", loanSubmit.LoanSubmitID)
+	} else if err != nil {
+		return Loan_Products.LoanProduct{}, fmt.Errorf("error querying loan terms: %v", err)
+	}
+	var product Loan_Products.LoanProduct
+	if err := json.Unmarshal(encoded, &product); err != nil {
+		return Loan_Products.LoanProduct{}, fmt.Errorf("error decoding loan terms of loan submit %d: %v", loanSubmit.LoanSubmitID, err)
+	}
+	return product, nil
+}
+
+// GetLoanSchedule looks up a loan submit and returns every version of its repayment schedule, oldest first
+func GetLoanSchedule(id int) (LoanSubmit, []ScheduleVersion, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return LoanSubmit{}, nil, err
+	}
+	defer db.Close()
+
+	var loanSubmit LoanSubmit
+	query := "SELECT " + loanSubmitColumns + " FROM loan_submits WHERE loanSubmit_id = $1"
+	if err := scanLoanSubmit(db.QueryRow(query, id), &loanSubmit); err != nil {
+		return LoanSubmit{}, nil, err
+	}
+
+	versions, err := loadScheduleVersions(db, loanSubmit)
+	if err != nil {
+		return LoanSubmit{}, nil, err
+	}
+	return loanSubmit, versions, nil
+}
+
+// CurrentInstallments returns the installments of the latest schedule version
+func CurrentInstallments(versions []ScheduleVersion) []Installment {
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions[len(versions)-1].Installments
+}
+
+// loadScheduleVersions reads the stored schedule versions of a loan submit, version 1 being the
+// schedule it was granted with
+func loadScheduleVersions(db *sql.DB, loanSubmit LoanSubmit) ([]ScheduleVersion, error) {
+	query := `SELECT s.schedule_version, COALESCE(r.effective_date, l.loan_date), COALESCE(r.interest_rate, l.interest_rate),
+			COALESCE(r.capitalize_arrears, FALSE), s.installment_no, s.period_start, s.due_date, s.principal_due, s.interest_due, s.interest_rate
+		FROM loan_schedules s
+		JOIN loan_submits l ON l.loanSubmit_id = s.loanSubmit_id
+		LEFT JOIN loan_restructures r ON r.loanSubmit_id = s.loanSubmit_id AND r.to_version = s.schedule_version
+		WHERE s.loanSubmit_id = $1
+		ORDER BY s.schedule_version, s.installment_no`
+	rows, err := db.Query(query, loanSubmit.LoanSubmitID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying loan schedules: %v", err)
+	}
+	defer rows.Close()
+
+	var versions []ScheduleVersion
+	for rows.Next() {
+		var version ScheduleVersion
+		var installment Installment
+		err := rows.Scan(&version.ScheduleVersion, &version.EffectiveDate, &version.InterestRate, &version.CapitalizeArrears,
+			&installment.InstallmentNo, &installment.PeriodStart, &installment.DueDate, &installment.PrincipalDue, &installment.InterestDue, &installment.InterestRate)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning loan schedule: %v", err)
+		}
+		if len(versions) == 0 || versions[len(versions)-1].ScheduleVersion != version.ScheduleVersion {
+			versions = append(versions, version)
+		}
+		current := &versions[len(versions)-1]
+		current.Installments = append(current.Installments, installment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("loan submit %d has no stored schedule", loanSubmit.LoanSubmitID)
+	}
+	return versions, nil
+}
+
+// UpdateLoanBalance stores the outstanding principal of a loan submit and marks it 'completed' once
+// nothing is owed on it any more, or 'ongoing' again if a reversal reopened it. A written-off loan is
+// off the books and keeps its status and zero balance whatever is recovered on it.
+func UpdateLoanBalance(id int, outstandingPrincipal decimal.Decimal, fullyPaid bool) error {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	loanStatus := "ongoing"
+	if fullyPaid {
+		loanStatus = "completed"
+	}
+
+	query := `UPDATE loan_submits SET outstanding_balance = $2, loan_status = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE loanSubmit_id = $1 AND loan_status <> 'written_off' AND (outstanding_balance <> $2 OR loan_status <> $3)`
+	result, err := db.Exec(query, id, outstandingPrincipal, loanStatus)
+	if err != nil {
+		return fmt.Errorf("error updating loan balance: %v", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		return runStatusHooks(id, loanStatus)
+	}
+	return nil
+}
+
+// StatusHook is run after the status of a loan submit has been set
+type StatusHook func(loanSubmitID int, loanStatus string) error
+
+var statusHooks []StatusHook
+
+// OnStatusChange registers a hook run whenever a loan submit is updated or its balance moves it between
+// 'ongoing' and 'completed', such as the release of its collateral. A deleted loan submit is reported
+// with the status 'deleted'.
+func OnStatusChange(hook StatusHook) {
+	statusHooks = append(statusHooks, hook)
+}
+
+func runStatusHooks(loanSubmitID int, loanStatus string) error {
+	for _, hook := range statusHooks {
+		if err := hook(loanSubmitID, loanStatus); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkWrittenOff takes an ongoing loan submit off the books, clearing its outstanding balance
+func MarkWrittenOff(id int) error {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	query := `UPDATE loan_submits SET outstanding_balance = 0, loan_status = 'written_off', updated_at = CURRENT_TIMESTAMP
+		WHERE loanSubmit_id = $1 AND loan_status = 'ongoing'`
+	if _, err := db.Exec(query, id); err != nil {
+		return fmt.Errorf("error writing off loan submit: %v", err)
+	}
+	return nil
+}
+
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
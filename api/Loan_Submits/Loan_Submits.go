@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,6 +12,9 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Applicants"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Products"
+	"github.com/SupachotT/Loan_Management_System.git/api/Reference_Rates"
 	"github.com/gorilla/mux"
 	"github.com/shopspring/decimal"
 )
@@ -72,13 +76,30 @@ func (cd CustomDate) Value() (driver.Value, error) {
 type LoanSubmit struct {
 	LoanSubmitID int
 	ApplicantID  int
+	ProductID    int
 	LoanAmount   decimal.Decimal
 	InterestRate decimal.Decimal
 	LoanDate     CustomDate // Use CustomDate
 	DueDate      CustomDate // Use CustomDate
 	LoanStatus   string
-	CreatedAt    string
-	UpdatedAt    string
+	// Principal still owed, kept up to date as payments are allocated
+	OutstandingBalance decimal.Decimal
+	// Margin over the reference index of a variable-rate product, InterestRate follows the index
+	RateMargin decimal.Decimal
+	// Co-borrowers and guarantors given on creation, and every party in loan detail responses
+	Parties []LoanParty `json:",omitempty"`
+	// Loan application the loan was granted on, at most one loan is granted per application
+	ApplicationID int `json:"-"`
+	CreatedAt     string
+	UpdatedAt     string
+}
+
+// Columns selected into a LoanSubmit by scanLoanSubmit
+const loanSubmitColumns = "loanSubmit_id, applicant_id, COALESCE(product_id, 0), loan_amount, interest_rate, rate_margin, loan_date, due_date, loan_status, outstanding_balance, created_at, updated_at"
+
+func scanLoanSubmit(row interface{ Scan(...interface{}) error }, loanSubmit *LoanSubmit) error {
+	return row.Scan(&loanSubmit.LoanSubmitID, &loanSubmit.ApplicantID, &loanSubmit.ProductID, &loanSubmit.LoanAmount, &loanSubmit.InterestRate, &loanSubmit.RateMargin,
+		&loanSubmit.LoanDate, &loanSubmit.DueDate, &loanSubmit.LoanStatus, &loanSubmit.OutstandingBalance, &loanSubmit.CreatedAt, &loanSubmit.UpdatedAt)
 }
 
 func connectLoanSubmitDB() (*sql.DB, error) {
@@ -106,6 +127,22 @@ func SetupDatabase() {
 		log.Fatal("Error creating loan_submits table:", err)
 	}
 
+	// Create the tables keeping schedule versions and restructures
+	if err := createLoanScheduleTables(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the table of the applicants liable for each loan
+	if err := createLoanPartyTable(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Read the limits on how much one applicant may owe
+	exposureLimits, err = readExposureLimitsFromFile("json/exposure_limits.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Read data from JSON file
 	loanSubmits, err := readSubmitFromFile("json/SubmittedApp.json")
 	if err != nil {
@@ -115,7 +152,23 @@ func SetupDatabase() {
 	// Insert each applicant into the database
 	for _, Submit := range loanSubmits {
 		pk := InsertLoanSubmit(db, Submit)
-		fmt.Printf("Inserted loan submit ID = %d\n", pk)
+		log.Printf("Inserted loan submit ID = %d", pk)
+
+		// Book the disbursement of the seeded loan
+		Submit.LoanSubmitID = pk
+		if err := postDisbursement(Submit); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The applicant of every loan is its primary borrower
+	if err := addPrimaryParties(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Every loan is settled from the schedule and product terms stored when it was granted
+	if err := storeMissingTerms(db); err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -136,19 +189,35 @@ func createLoanSubmitTable(db *sql.DB) error {
 	if err != nil {
 		return fmt.Errorf("error creating loan_submits table: %v", err)
 	}
+
+	// Columns added after the table was first created
+	queries := []string{
+		`ALTER TABLE loan_submits ADD COLUMN IF NOT EXISTS outstanding_balance DECIMAL(15, 2) NOT NULL DEFAULT 0`,
+		`ALTER TABLE loan_submits ADD COLUMN IF NOT EXISTS product_id INT`,
+		`ALTER TABLE loan_submits ADD COLUMN IF NOT EXISTS rate_margin DECIMAL(5, 2) NOT NULL DEFAULT 0`,
+		`ALTER TABLE loan_submits ADD COLUMN IF NOT EXISTS application_id INT UNIQUE`,
+		// Loan statuses allowed, replaced whenever a new status is introduced
+		`ALTER TABLE loan_submits DROP CONSTRAINT IF EXISTS loan_submits_loan_status_check`,
+		`ALTER TABLE loan_submits ADD CONSTRAINT loan_submits_loan_status_check CHECK (loan_status IN ('ongoing', 'completed', 'written_off'))`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("error altering loan_submits table: %v", err)
+		}
+	}
 	return nil
 }
 
 func InsertLoanSubmit(db *sql.DB, loanSubmitt LoanSubmit) int {
-	query := `INSERT INTO loan_submits (applicant_id, loan_amount, interest_rate, loan_date, due_date, loan_status)
-            VALUES ($1, $2, $3, $4, $5, $6) RETURNING loanSubmit_id`
+	query := `INSERT INTO loan_submits (applicant_id, product_id, loan_amount, interest_rate, loan_date, due_date, loan_status, outstanding_balance, rate_margin)
+            VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7, $3, $8) RETURNING loanSubmit_id`
 
 	var loanSubmitID int
 	// Format time.Time to PostgreSQL DATE format
 	loanDate := loanSubmitt.LoanDate.Format("2006-01-02")
 	dueDate := loanSubmitt.DueDate.Format("2006-01-02")
 
-	err := db.QueryRow(query, loanSubmitt.ApplicantID, loanSubmitt.LoanAmount, loanSubmitt.InterestRate, loanDate, dueDate, loanSubmitt.LoanStatus).Scan(&loanSubmitID)
+	err := db.QueryRow(query, loanSubmitt.ApplicantID, loanSubmitt.ProductID, loanSubmitt.LoanAmount, loanSubmitt.InterestRate, loanDate, dueDate, loanSubmitt.LoanStatus, loanSubmitt.RateMargin).Scan(&loanSubmitID)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -171,6 +240,188 @@ func readSubmitFromFile(filename string) ([]LoanSubmit, error) {
 	return loanSubmits, nil
 }
 
+// checkLoanProduct validates the amount, interest rate and dates of a loan submit against its loan
+// product and returns the HTTP status to answer with when they don't fit. The interest rate of a
+// variable-rate loan is set from the reference index on its LoanDate plus its RateMargin.
+func checkLoanProduct(loanSubmit *LoanSubmit) (int, error) {
+	if loanSubmit.ProductID <= 0 {
+		return http.StatusBadRequest, fmt.Errorf("ProductID is required")
+	}
+
+	product, err := Loan_Products.FindLoanProduct(loanSubmit.ProductID)
+	if err == sql.ErrNoRows {
+		return http.StatusBadRequest, fmt.Errorf("loan product %d not found", loanSubmit.ProductID)
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	switch product.RateType {
+	case "variable":
+		indexRate, err := Reference_Rates.RateOn(product.ReferenceIndex, loanSubmit.LoanDate.Time)
+		if err != nil {
+			return http.StatusUnprocessableEntity, err
+		}
+		loanSubmit.InterestRate = product.ClampRate(indexRate.Add(loanSubmit.RateMargin))
+	default:
+		if !loanSubmit.RateMargin.IsZero() {
+			return http.StatusBadRequest, fmt.Errorf("RateMargin only applies to variable rate products")
+		}
+	}
+
+	if err := product.CheckLoanTerms(loanSubmit.LoanAmount, loanSubmit.InterestRate, loanSubmit.LoanDate.Time, loanSubmit.DueDate.Time); err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	return http.StatusOK, nil
+}
+
+// ErrorResponse is the JSON body answering a loan submit that can't be granted. A breached exposure
+// limit is explained with the applicant's current exposure.
+func ErrorResponse(err error) map[string]interface{} {
+	errorResponse := map[string]interface{}{"error": err.Error()}
+	var exposureErr *ExposureLimitError
+	if errors.As(err, &exposureErr) {
+		errorResponse["limit"] = exposureErr.Limit
+		errorResponse["current_exposure"] = exposureErr.Exposure
+	}
+	return errorResponse
+}
+
+// SubmitLoan validates a new loan submit against its product and the exposure limits of each of its
+// parties, stores it with its parties and books its disbursement. The borrowers become current borrowers.
+// It returns the HTTP status to answer with when the loan can't be granted, with an *ExposureLimitError
+// when a limit would be breached.
+func SubmitLoan(loanSubmit *LoanSubmit) (int, error) {
+	if loanSubmit.LoanStatus != "ongoing" && loanSubmit.LoanStatus != "completed" {
+		return http.StatusBadRequest, fmt.Errorf("Invalid loan status: '%s'. Allowed values are 'ongoing' or 'completed'.", loanSubmit.LoanStatus)
+	}
+
+	// A loan already granted on the application is finished off instead of granting a second one, so
+	// that an approval retried after a failure can't disburse twice
+	if loanSubmit.ApplicationID != 0 {
+		granted, found, err := findApplicationLoan(loanSubmit.ApplicationID)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if found {
+			*loanSubmit = granted
+			if err := completeGrant(*loanSubmit); err != nil {
+				return http.StatusInternalServerError, err
+			}
+			return http.StatusOK, nil
+		}
+	}
+
+	// Validate the loan against the terms of its product and its parties
+	if status, err := checkLoanProduct(loanSubmit); err != nil {
+		return status, err
+	}
+	if status, err := validateLoanParties(*loanSubmit); err != nil {
+		return status, err
+	}
+
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	// Loans of the same applicant are granted one at a time so that both can't fit under the same limit
+	tx, err := db.Begin()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+	parties := allParties(*loanSubmit)
+	if err := lockParties(tx, parties); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// An ongoing loan must keep every party within the exposure limits
+	if loanSubmit.LoanStatus == "ongoing" {
+		for _, party := range parties {
+			exposure, err := currentExposure(tx, party.ApplicantID, 0)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			if err := checkExposure(exposure, party, *loanSubmit); err != nil {
+				return http.StatusUnprocessableEntity, err
+			}
+		}
+	}
+
+	// Insert loan submission into the database
+	query := `INSERT INTO loan_submits (applicant_id, product_id, loan_amount, interest_rate, loan_date, due_date, loan_status, outstanding_balance, rate_margin, application_id)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $3, $8, NULLIF($9, 0)) RETURNING loanSubmit_id`
+
+	// Format time.Time to PostgreSQL DATE format
+	loanDate := loanSubmit.LoanDate.Format("2006-01-02")
+	dueDate := loanSubmit.DueDate.Format("2006-01-02")
+
+	err = tx.QueryRow(query, loanSubmit.ApplicantID, loanSubmit.ProductID, loanSubmit.LoanAmount, loanSubmit.InterestRate, loanDate, dueDate, loanSubmit.LoanStatus, loanSubmit.RateMargin, loanSubmit.ApplicationID).Scan(&loanSubmit.LoanSubmitID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	parties = allParties(*loanSubmit)
+	if err := insertLoanParties(tx, parties); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := storeGrantedTerms(tx, *loanSubmit); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := tx.Commit(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	loanSubmit.Parties = parties
+
+	if err := completeGrant(*loanSubmit); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusCreated, nil
+}
+
+// completeGrant books the disbursement of a granted loan and marks its borrowers. Both steps can be
+// repeated, so a grant interrupted after the loan was stored is completed by running it again.
+func completeGrant(loanSubmit LoanSubmit) error {
+	// Book the disbursement in the general ledger
+	if err := postDisbursement(loanSubmit); err != nil {
+		return err
+	}
+
+	// The borrowers granted a loan are current borrowers from now on, guarantors aren't
+	for _, party := range loanSubmit.Parties {
+		if party.PartyRole == "guarantor" {
+			continue
+		}
+		if err := Loan_Applicants.MarkCurrentBorrower(party.ApplicantID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findApplicationLoan looks up the loan granted on a loan application together with its parties
+func findApplicationLoan(applicationID int) (LoanSubmit, bool, error) {
+	db, err := connectLoanSubmitDB()
+	if err != nil {
+		return LoanSubmit{}, false, err
+	}
+	defer db.Close()
+
+	var loanSubmit LoanSubmit
+	query := "SELECT " + loanSubmitColumns + " FROM loan_submits WHERE application_id = $1"
+	err = scanLoanSubmit(db.QueryRow(query, applicationID), &loanSubmit)
+	if err == sql.ErrNoRows {
+		return LoanSubmit{}, false, nil
+	} else if err != nil {
+		return LoanSubmit{}, false, err
+	}
+	loanSubmit.ApplicationID = applicationID
+	if loanSubmit.Parties, err = loadLoanParties(db, loanSubmit.LoanSubmitID); err != nil {
+		return LoanSubmit{}, false, err
+	}
+	return loanSubmit, true, nil
+}
+
 func GetLoanSubmit(w http.ResponseWriter, r *http.Request) {
 	db, err := connectLoanSubmitDB()
 	if err != nil {
@@ -179,7 +430,7 @@ func GetLoanSubmit(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 
 	// Query from the loan_submits table
-	rows, err := db.Query("SELECT loanSubmit_id, applicant_id, loan_amount, interest_rate, loan_date, due_date, loan_status, created_at, updated_at FROM loan_submits")
+	rows, err := db.Query("SELECT " + loanSubmitColumns + " FROM loan_submits")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -189,8 +440,7 @@ func GetLoanSubmit(w http.ResponseWriter, r *http.Request) {
 	var loan_Submits []LoanSubmit
 	for rows.Next() {
 		var loanSubmit LoanSubmit
-		if err := rows.Scan(&loanSubmit.LoanSubmitID, &loanSubmit.ApplicantID, &loanSubmit.LoanAmount, &loanSubmit.InterestRate,
-			&loanSubmit.LoanDate, &loanSubmit.DueDate, &loanSubmit.LoanStatus, &loanSubmit.CreatedAt, &loanSubmit.UpdatedAt); err != nil {
+		if err := scanLoanSubmit(rows, &loanSubmit); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -224,9 +474,8 @@ func GetLoanSubmitByID(w http.ResponseWriter, r *http.Request) {
 
 	// Query database for loan_submits with given loanSubmit_id
 	var loanSubmit LoanSubmit
-	query := `SELECT loanSubmit_id, applicant_id, loan_amount, interest_rate, loan_date, due_date, loan_status, created_at, updated_at FROM loan_submits WHERE loanSubmit_id = $1`
-	err = db.QueryRow(query, id).Scan(&loanSubmit.LoanSubmitID, &loanSubmit.ApplicantID, &loanSubmit.LoanAmount, &loanSubmit.InterestRate,
-		&loanSubmit.LoanDate, &loanSubmit.DueDate, &loanSubmit.LoanStatus, &loanSubmit.CreatedAt, &loanSubmit.UpdatedAt)
+	query := "SELECT " + loanSubmitColumns + " FROM loan_submits WHERE loanSubmit_id = $1"
+	err = scanLoanSubmit(db.QueryRow(query, id), &loanSubmit)
 	if err == sql.ErrNoRows {
 		// Return JSON error response if no loan submit with the given ID exists
 		errorResponse := map[string]string{"error": "loan_submits data not found"}
@@ -239,58 +488,44 @@ func GetLoanSubmitByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Include everyone liable for the loan
+	loanSubmit.Parties, err = loadLoanParties(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Return JSON response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(loanSubmit)
 }
 
 func CreateLoanSubmit(w http.ResponseWriter, r *http.Request) {
-	db, err := connectLoanSubmitDB()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error connecting to the database: %v", err), http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
 	// Parse JSON request body
 	var loanSubmit LoanSubmit
-	err = json.NewDecoder(r.Body).Decode(&loanSubmit)
+	err := json.NewDecoder(r.Body).Decode(&loanSubmit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Insert loan submission into the database
-	query := `INSERT INTO loan_submits (applicant_id, loan_amount, interest_rate, loan_date, due_date, loan_status)
-            VALUES ($1, $2, $3, $4, $5, $6) RETURNING loanSubmit_id`
-
-	var loanSubmitID int
-	// Format time.Time to PostgreSQL DATE format
-	loanDate := loanSubmit.LoanDate.Format("2006-01-02")
-	dueDate := loanSubmit.DueDate.Format("2006-01-02")
-
-	err = db.QueryRow(query, loanSubmit.ApplicantID, loanSubmit.LoanAmount, loanSubmit.InterestRate, loanDate, dueDate, loanSubmit.LoanStatus).Scan(&loanSubmitID)
-	if err != nil {
-		if loanSubmit.LoanStatus != "ongoing" && loanSubmit.LoanStatus != "completed" {
-			// If loan status is invalid, return a specific JSON response
-			errorMessage := map[string]string{
-				"error": fmt.Sprintf("Invalid loan status: '%s'. Allowed values are 'ongoing' or 'completed'.", loanSubmit.LoanStatus),
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest) // HTTP 400 Bad Request
-			json.NewEncoder(w).Encode(errorMessage)
+	// Validate the loan, store it and book its disbursement
+	if status, err := SubmitLoan(&loanSubmit); err != nil {
+		if status == http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
 			return
 		}
-
-		// For other errors, return a generic internal server error
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		errorResponse := ErrorResponse(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorResponse)
 		return
 	}
 
 	// Prepare success message
 	successMessage := map[string]interface{}{
 		"message":       "Loan submission information has been successfully created.",
-		"loanSubmit_id": loanSubmitID,
+		"loanSubmit_id": loanSubmit.LoanSubmitID,
 	}
 
 	// Set Content-Type and return JSON response
@@ -333,29 +568,137 @@ func UpdateLoanSubmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Validate the loan against the terms of its product
+	if status, err := checkLoanProduct(&updateloanSubmit); err != nil {
+		errorResponse := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// The loan, its parties and the schedule it is granted with change together
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var current LoanSubmit
+	err = scanLoanSubmit(tx.QueryRow("SELECT "+loanSubmitColumns+" FROM loan_submits WHERE loanSubmit_id = $1 FOR UPDATE", id), &current)
+	if err == sql.ErrNoRows {
+		errorResponse := map[string]string{"error": "Loan Submit ID not found or no update performed"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A written-off loan is off the books, so it is kept as it was when it was written off
+	if current.LoanStatus == "written_off" {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Loan submission %d has been written off and can no longer be changed", id)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// A restructured loan is repaid on its stored schedule versions, so its terms can't be edited any more
+	var restructured bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM loan_restructures WHERE loanSubmit_id = $1)`, id).Scan(&restructured)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if restructured {
+		errorResponse := map[string]string{"error": fmt.Sprintf("Loan submission %d has been restructured, its terms can only be changed by a further restructure", id)}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict) // HTTP 409 Conflict
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// The applicant of the loan stays its primary borrower, next to its other parties
+	parties, err := loadLoanParties(tx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, party := range parties {
+		if party.PartyRole == "primary" {
+			parties[i].ApplicantID = updateloanSubmit.ApplicantID
+		} else if party.ApplicantID == updateloanSubmit.ApplicantID {
+			errorResponse := map[string]string{"error": fmt.Sprintf("applicant %d is already a %s of loan submission %d", party.ApplicantID, party.PartyRole, id)}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errorResponse)
+			return
+		}
+	}
+
+	// A loan that becomes ongoing, grows or moves to another applicant must keep every party within the
+	// exposure limits, checked the way a new loan is
+	if updateloanSubmit.LoanStatus == "ongoing" && (current.LoanStatus != "ongoing" ||
+		updateloanSubmit.LoanAmount.GreaterThan(current.LoanAmount) || updateloanSubmit.ApplicantID != current.ApplicantID) {
+		if err := lockParties(tx, parties); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, party := range parties {
+			exposure, err := currentExposure(tx, party.ApplicantID, id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := checkExposure(exposure, party, updateloanSubmit); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(ErrorResponse(err))
+				return
+			}
+		}
+	}
+
 	// Update query
 	query := `UPDATE loan_submits 
-			  SET applicant_id = $1, loan_amount = $2, interest_rate = $3, loan_date = $4, due_date = $5, loan_status = $6, updated_at = CURRENT_TIMESTAMP
+			  SET applicant_id = $1, loan_amount = $2, outstanding_balance = outstanding_balance + $2 - loan_amount, interest_rate = $3, loan_date = $4, due_date = $5, loan_status = $6, product_id = $8, rate_margin = $9, updated_at = CURRENT_TIMESTAMP
               WHERE loanSubmit_id = $7`
 
 	// Format time.Time to PostgreSQL DATE format
 	loanDate := updateloanSubmit.LoanDate.Format("2006-01-02")
 	dueDate := updateloanSubmit.DueDate.Format("2006-01-02")
 
-	result, err := db.Exec(query, updateloanSubmit.ApplicantID, updateloanSubmit.LoanAmount, updateloanSubmit.InterestRate, loanDate, dueDate, updateloanSubmit.LoanStatus, updateloanSubmit.LoanSubmitID)
+	_, err = tx.Exec(query, updateloanSubmit.ApplicantID, updateloanSubmit.LoanAmount, updateloanSubmit.InterestRate, loanDate, dueDate, updateloanSubmit.LoanStatus, id, updateloanSubmit.ProductID, updateloanSubmit.RateMargin)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	query = `UPDATE loan_parties SET applicant_id = $1 WHERE loanSubmit_id = $2 AND party_role = 'primary'`
+	if _, err := tx.Exec(query, updateloanSubmit.ApplicantID, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	updateloanSubmit.LoanSubmitID = id
+	if err := storeGrantedTerms(tx, updateloanSubmit); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	// Check if any rows were affected
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		// Return JSON error response if no Loan Submit with the given ID was found to update
-		errorResponse := map[string]string{"error": "Loan Submit ID not found or no update performed"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(errorResponse)
+	// Adjust the booked disbursement to the updated loan amount
+	if err := postDisbursement(updateloanSubmit); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := runStatusHooks(id, updateloanSubmit.LoanStatus); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -400,6 +743,17 @@ func DeleteLoanSubmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reverse everything booked against the deleted loan
+	if err := reverseLoanJournals(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// and release whatever was pledged to it
+	if err := runStatusHooks(id, "deleted"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Return success message
 	w.WriteHeader(http.StatusOK)
 	successMessage := map[string]string{"message": fmt.Sprintf("Loan submission with ID %d deleted successfully", id)}
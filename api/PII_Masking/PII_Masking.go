@@ -0,0 +1,284 @@
+package PII_Masking
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// RolePolicy lists the permissions of every role. Callers are given their role by the bearer token
+// they send in the Authorization header, looked up in TokensFile, which is kept out of the repository
+// like the other keys. Callers without a known token get DefaultRole.
+//
+// TokensFile maps every token to the role of its holder, either as the role alone or as an object with
+// the Role and the Name of the holder, which is recorded as who made the changes sent with the token.
+type RolePolicy struct {
+	DefaultRole string
+	Roles       map[string][]string
+	TokensFile  string
+}
+
+// UnmaskPermission lets a role see personal data in full
+const UnmaskPermission = "unmask_pii"
+
+// tokenHolder is who an API token was given to
+type tokenHolder struct {
+	Role string
+	Name string
+}
+
+// UnmarshalJSON reads a token holder given as an object or as a role alone
+func (holder *tokenHolder) UnmarshalJSON(data []byte) error {
+	var role string
+	if err := json.Unmarshal(data, &role); err == nil {
+		*holder = tokenHolder{Role: role}
+		return nil
+	}
+	type plain tokenHolder
+	return json.Unmarshal(data, (*plain)(holder))
+}
+
+var (
+	rolePolicy RolePolicy
+	// tokenHolders holds the holder of every API token
+	tokenHolders map[string]tokenHolder
+)
+
+// Setup reads the permissions of every role and the roles of the API tokens
+func Setup() {
+	policy, err := readRolePolicyFromFile("json/pii_roles.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	rolePolicy = policy
+	tokenHolders, err = readTokenHoldersFromFile(policy.TokensFile, policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readRolePolicyFromFile(filename string) (RolePolicy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return RolePolicy{}, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var policy RolePolicy
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&policy); err != nil {
+		return RolePolicy{}, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	if _, ok := policy.Roles[policy.DefaultRole]; !ok {
+		return RolePolicy{}, fmt.Errorf("invalid role policy: DefaultRole %q is not one of the Roles", policy.DefaultRole)
+	}
+	return policy, nil
+}
+
+// readTokenHoldersFromFile reads the holder of every API token. Without a tokens file no caller is
+// known and everyone gets the default role. A holder without a name is named after their role and a
+// fingerprint of their token, which never reveals the token itself.
+func readTokenHoldersFromFile(filename string, policy RolePolicy) (map[string]tokenHolder, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		log.Printf("No API tokens in %s, every caller gets role %s", filename, policy.DefaultRole)
+		return map[string]tokenHolder{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var holders map[string]tokenHolder
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&holders); err != nil {
+		return nil, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	for token, holder := range holders {
+		if token == "" {
+			return nil, fmt.Errorf("invalid API tokens: a token must not be empty")
+		}
+		if _, ok := policy.Roles[holder.Role]; !ok {
+			return nil, fmt.Errorf("invalid API tokens: role %q is not one of the Roles", holder.Role)
+		}
+		if holder.Name == "" {
+			fingerprint := sha256.Sum256([]byte(token))
+			holder.Name = fmt.Sprintf("%s token %s", holder.Role, hex.EncodeToString(fingerprint[:4]))
+			holders[token] = holder
+		}
+	}
+	return holders, nil
+}
+
+// callerHolder is the holder of the bearer token a request was sent with, if it is a known token
+func callerHolder(r *http.Request) (tokenHolder, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return tokenHolder{}, false
+	}
+	holder, ok := tokenHolders[strings.TrimSpace(token)]
+	return holder, ok
+}
+
+// callerRole is the role of the bearer token a request was sent with, the default role without a
+// known token
+func callerRole(r *http.Request) string {
+	holder, ok := callerHolder(r)
+	if !ok {
+		return rolePolicy.DefaultRole
+	}
+	return holder.Role
+}
+
+// CallerName is the name of the holder of the bearer token a request was sent with. It reports false
+// for callers without a known token, whose changes can't be traced to anyone.
+func CallerName(r *http.Request) (string, bool) {
+	holder, ok := callerHolder(r)
+	return holder.Name, ok
+}
+
+// CanUnmask reports whether the caller of a request may see personal data in full
+func CanUnmask(r *http.Request) bool {
+	permissions := rolePolicy.Roles[callerRole(r)]
+	for _, permission := range permissions {
+		if permission == UnmaskPermission {
+			return true
+		}
+	}
+	return false
+}
+
+// maskDigits replaces every digit of a value after the first keep digits with '*', leaving separators
+func maskDigits(value string, keep int) string {
+	masked := []rune(value)
+	for i, r := range masked {
+		if r >= '0' && r <= '9' {
+			if keep > 0 {
+				keep--
+			} else {
+				masked[i] = '*'
+			}
+		}
+	}
+	return string(masked)
+}
+
+// MaskPhone keeps the first three digits of a phone number, as in '555-****'
+func MaskPhone(phone string) string {
+	return maskDigits(phone, 3)
+}
+
+// MaskEmail keeps the first letter of the local part and the domain, as in 'a***@example.com'
+func MaskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// MaskAddress keeps only the last word of an address, as in '*** Bangkok'
+func MaskAddress(address string) string {
+	words := strings.Fields(address)
+	if len(words) < 2 {
+		return "***"
+	}
+	return "*** " + words[len(words)-1]
+}
+
+// MaskNationalID keeps the last four digits of a national ID number, as in '*********0708'
+func MaskNationalID(nationalID string) string {
+	if len(nationalID) <= 4 {
+		return strings.Repeat("*", len(nationalID))
+	}
+	return strings.Repeat("*", len(nationalID)-4) + nationalID[len(nationalID)-4:]
+}
+
+// MaskName keeps the first letter of a name, as in 'A***'
+func MaskName(name string) string {
+	for _, r := range name {
+		return string(r) + "***"
+	}
+	return ""
+}
+
+// MaskFileName keeps only the extension of a file name, as in '***.pdf'
+func MaskFileName(fileName string) string {
+	return "***" + filepath.Ext(fileName)
+}
+
+// MaskDate keeps the year of a YYYY-MM-DD date, as in '1990-**-**'
+func MaskDate(date string) string {
+	if len(date) != 10 {
+		return "****-**-**"
+	}
+	return date[:4] + "-**-**"
+}
+
+// Personal data that may turn up in log output: emails, Thai national ID numbers written whole or as
+// 1-2345-67890-12-3, and phone numbers such as 555-0001, 02 123 4567 or +66 81 234 5678
+var (
+	emailPattern      = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	nationalIDPattern = regexp.MustCompile(`\b\d{13}\b|\b\d-\d{4}-\d{5}-\d{2}-\d\b`)
+	phonePattern      = regexp.MustCompile(`(?:\+\d{1,3}[- ]?)?\b\d{2,3}[- ]\d{3,4}[- ]\d{4}\b|\b\d{3}-\d{4}\b`)
+)
+
+// Redact masks the personal data found in free text
+func Redact(text string) string {
+	text = emailPattern.ReplaceAllStringFunc(text, MaskEmail)
+	text = nationalIDPattern.ReplaceAllStringFunc(text, func(nationalID string) string {
+		return maskDigits(nationalID, 0)
+	})
+	return phonePattern.ReplaceAllStringFunc(text, MaskPhone)
+}
+
+// redactingWriter masks the personal data in everything written through it
+type redactingWriter struct {
+	out io.Writer
+}
+
+// NewRedactingWriter wraps the output of a logger so that personal data never reaches the logs, as in
+// log.SetOutput(NewRedactingWriter(os.Stderr))
+func NewRedactingWriter(out io.Writer) io.Writer {
+	return redactingWriter{out: out}
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// RedactErrors is middleware that masks the personal data in the bodies of error responses, which
+// often pass on a database error quoting the values of a row, as in router.Use(RedactErrors)
+func RedactErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&errorRedactingWriter{ResponseWriter: w}, r)
+	})
+}
+
+// errorRedactingWriter redacts what is written once a response has been given an error status
+type errorRedactingWriter struct {
+	http.ResponseWriter
+	redact bool
+}
+
+func (w *errorRedactingWriter) WriteHeader(status int) {
+	w.redact = status >= http.StatusBadRequest
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorRedactingWriter) Write(p []byte) (int, error) {
+	if !w.redact {
+		return w.ResponseWriter.Write(p)
+	}
+	return redactingWriter{out: w.ResponseWriter}.Write(p)
+}
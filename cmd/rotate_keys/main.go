@@ -0,0 +1,26 @@
+// Command rotate_keys re-encrypts the personal data of loan applicants under the active key-encryption
+// key, in batches. With -new-key it first makes a new key active.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Applicants"
+)
+
+func main() {
+	newKey := flag.Bool("new-key", false, "make a new key-encryption key active before re-encrypting")
+	batchSize := flag.Int("batch", 0, "rows re-encrypted per transaction, RotationBatchSize of json/field_encryption.json by default")
+	flag.Parse()
+
+	if err := Loan_Applicants.LoadFieldEncryption(); err != nil {
+		log.Fatal(err)
+	}
+	rotated, err := Loan_Applicants.RotateFieldKeys(*newKey, *batchSize)
+	if err != nil {
+		log.Fatalf("Key rotation stopped after %d rows: %v", rotated, err)
+	}
+	fmt.Printf("Re-encrypted %d rows\n", rotated)
+}
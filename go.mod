@@ -1,9 +1,30 @@
 module github.com/SupachotT/Loan_Management_System.git
 
-go 1.22.5
+go 1.23.0
 
 require github.com/lib/pq v1.10.9
 
 require github.com/gorilla/mux v1.8.1
 
 require github.com/shopspring/decimal v1.4.0
+
+require (
+	github.com/minio/minio-go/v7 v7.0.90
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/go-ini/ini v1.67.0 // indirect
+	github.com/goccy/go-json v0.10.5 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
+	github.com/minio/crc64nvme v1.0.1 // indirect
+	github.com/minio/md5-simd v1.1.2 // indirect
+	github.com/rs/xid v1.6.0 // indirect
+	golang.org/x/crypto v0.36.0 // indirect
+	golang.org/x/net v0.38.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+)
@@ -1,42 +1,129 @@
 package main
 
 import (
-	"fmt"
+	"log"
 	"net/http"
+	"os"
 
+	"github.com/SupachotT/Loan_Management_System.git/api/Applicant_Duplicates"
+	"github.com/SupachotT/Loan_Management_System.git/api/Applicant_Erasure"
+	"github.com/SupachotT/Loan_Management_System.git/api/Borrower_Summaries"
+	"github.com/SupachotT/Loan_Management_System.git/api/Calendars"
+	"github.com/SupachotT/Loan_Management_System.git/api/Credit_Scores"
+	"github.com/SupachotT/Loan_Management_System.git/api/General_Ledger"
 	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Applicants"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Applications"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Collateral"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Collections"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Delinquency"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Documents"
 	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Payments"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Products"
+	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Restructures"
 	"github.com/SupachotT/Loan_Management_System.git/api/Loan_Submits"
+	"github.com/SupachotT/Loan_Management_System.git/api/PII_Masking"
+	"github.com/SupachotT/Loan_Management_System.git/api/Reference_Rates"
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	// Personal data is masked in the logs and error responses, and in responses to roles that may not
+	// see it in full
+	log.SetOutput(PII_Masking.NewRedactingWriter(os.Stderr))
+	PII_Masking.Setup()
+
 	// Call the function from the imported package
+	General_Ledger.SetupDatabase()
 	Loan_Applicants.SetupDatabase()
+	Loan_Products.SetupDatabase()
+	Reference_Rates.SetupDatabase()
 	Loan_Submits.SetupDatabase()
+	Loan_Applications.SetupDatabase()
 	Loan_Payments.SetupDatabase()
+	Loan_Delinquency.SetupDatabase()
+	Loan_Collections.SetupDatabase()
+	Credit_Scores.SetupDatabase()
+	Loan_Collateral.SetupDatabase()
+	Loan_Documents.SetupDatabase()
+	Applicant_Duplicates.SetupDatabase()
+	Applicant_Erasure.SetupDatabase()
+
+	// Start background jobs, rate resets that have fallen due are applied before every delinquency job,
+	// collection cases are reviewed, applicants rescored and checked for duplicates and pending erasure
+	// requests retried after it, and the applicant is rescored and the collection case of the loan
+	// reviewed after every payment
+	Loan_Delinquency.BeforeJob(Loan_Restructures.ResetRatesNightly)
+	Loan_Delinquency.AfterJob(Loan_Collections.ReviewCases)
+	Loan_Delinquency.AfterJob(Credit_Scores.RescoreNightly)
+	Loan_Delinquency.AfterJob(Applicant_Duplicates.DetectNightly)
+	Loan_Delinquency.AfterJob(Applicant_Erasure.ProcessNightly)
+	Loan_Payments.AfterPayment(Credit_Scores.RescoreAfterPayment)
+	Loan_Payments.AfterPayment(Loan_Collections.ReviewAfterPayment)
+
+	// Collateral is released once the loan it secures is completed, and pledged again if a reversal
+	// reopens the loan
+	Loan_Submits.OnStatusChange(Loan_Collateral.UpdateLoanCollateral)
+
+	// Variable-rate loans are recalculated when the values of their reference index are loaded or corrected
+	Reference_Rates.AfterRatesChange(Loan_Restructures.RecalculateRates)
+
+	// Applicants the loan records refer to are anonymized rather than deleted
+	Loan_Applicants.BeforeDelete(Applicant_Erasure.CheckApplicantDelete)
+	Loan_Delinquency.StartDailyJob()
 
 	// Start server
 	router := mux.NewRouter()
+	router.Use(PII_Masking.RedactErrors)
 	handleRoutes(router)
 
-	fmt.Println("Server listening on port 8080...")
-	fmt.Println(http.ListenAndServe(":8080", router))
+	log.Println("Server listening on port 8080...")
+	log.Println(http.ListenAndServe(":8080", router))
 }
 
 func handleRoutes(router *mux.Router) {
 	// Define API endpoints for Loan Applicants
 	applicantsRouter := router.PathPrefix("/loan_applicants").Subrouter()
 	applicantsRouter.HandleFunc("/all", Loan_Applicants.GetApplicants).Methods("GET")
+	applicantsRouter.HandleFunc("/consenting/{purpose}", Loan_Applicants.GetConsentingApplicants).Methods("GET")
 	applicantsRouter.HandleFunc("/{id}", Loan_Applicants.GetApplicantByID).Methods("GET")
+	applicantsRouter.HandleFunc("/{id}/profile", Loan_Applicants.GetApplicantProfile).Methods("GET")
+	applicantsRouter.HandleFunc("/{id}/profile", Loan_Applicants.UpdateApplicantProfile).Methods("PUT")
+	applicantsRouter.HandleFunc("/{id}/profile/history", Loan_Applicants.GetApplicantProfileHistory).Methods("GET")
+	applicantsRouter.HandleFunc("/{id}/consents", Loan_Applicants.GetApplicantConsents).Methods("GET")
+	applicantsRouter.HandleFunc("/{id}/consents", Loan_Applicants.UpdateApplicantConsents).Methods("PUT")
+	applicantsRouter.HandleFunc("/{id}/consents/history", Loan_Applicants.GetApplicantConsentHistory).Methods("GET")
+	applicantsRouter.HandleFunc("/{id}/score", Credit_Scores.GetApplicantScore).Methods("GET")
+	applicantsRouter.HandleFunc("/{id}/documents", Loan_Documents.GetApplicantDocuments).Methods("GET")
+	applicantsRouter.HandleFunc("/{id}/documents", Loan_Documents.UploadApplicantDocument).Methods("POST")
+	applicantsRouter.HandleFunc("/{id}/documents/{documentID}", Loan_Documents.DownloadApplicantDocument).Methods("GET")
 	applicantsRouter.HandleFunc("/create", Loan_Applicants.CreateApplicants).Methods("POST")
 	applicantsRouter.HandleFunc("/update/{id}", Loan_Applicants.UpdateApplicants).Methods("PUT")
 	applicantsRouter.HandleFunc("/delete/{id}", Loan_Applicants.DeleteApplicants).Methods("DELETE")
 
+	// Define API endpoints for Loan Products
+	productsRouter := router.PathPrefix("/loan_products").Subrouter()
+	productsRouter.HandleFunc("/all", Loan_Products.GetLoanProducts).Methods("GET")
+	productsRouter.HandleFunc("/{id}", Loan_Products.GetLoanProductByID).Methods("GET")
+	productsRouter.HandleFunc("/create", Loan_Products.CreateLoanProduct).Methods("POST")
+	productsRouter.HandleFunc("/update/{id}", Loan_Products.UpdateLoanProduct).Methods("PUT")
+
+	// Define API endpoints for Loan Applications
+	applicationsRouter := router.PathPrefix("/loan_applications").Subrouter()
+	applicationsRouter.HandleFunc("/all", Loan_Applications.GetLoanApplications).Methods("GET")
+	applicationsRouter.HandleFunc("/{id}", Loan_Applications.GetLoanApplicationByID).Methods("GET")
+	applicationsRouter.HandleFunc("/create", Loan_Applications.CreateLoanApplication).Methods("POST")
+	applicationsRouter.HandleFunc("/evaluate/{id}", Loan_Applications.EvaluateLoanApplication).Methods("GET")
+	applicationsRouter.HandleFunc("/review/{id}", Loan_Applications.ReviewLoanApplication).Methods("POST")
+	applicationsRouter.HandleFunc("/approve/{id}", Loan_Applications.ApproveLoanApplication).Methods("POST")
+	applicationsRouter.HandleFunc("/decline/{id}", Loan_Applications.DeclineLoanApplication).Methods("POST")
+	applicationsRouter.HandleFunc("/withdraw/{id}", Loan_Applications.WithdrawLoanApplication).Methods("POST")
+
 	// Define API endpoints for Loan Submits
 	submitsRouter := router.PathPrefix("/loan_submits").Subrouter()
 	submitsRouter.HandleFunc("/all", Loan_Submits.GetLoanSubmit).Methods("GET")
+	submitsRouter.HandleFunc("/accrue_interest", Loan_Payments.AccrueInterest).Methods("POST")
 	submitsRouter.HandleFunc("/{id}", Loan_Submits.GetLoanSubmitByID).Methods("GET")
+	submitsRouter.HandleFunc("/{id}/documents", Loan_Documents.GetLoanSubmitDocuments).Methods("GET")
 	submitsRouter.HandleFunc("/create", Loan_Submits.CreateLoanSubmit).Methods("POST")
 	submitsRouter.HandleFunc("/update/{id}", Loan_Submits.UpdateLoanSubmit).Methods("PUT")
 	submitsRouter.HandleFunc("/delete/{id}", Loan_Submits.DeleteLoanSubmit).Methods("DELETE")
@@ -48,4 +135,78 @@ func handleRoutes(router *mux.Router) {
 	paymentsRouter.HandleFunc("/create", Loan_Payments.CreateLoanPayment).Methods("POST")
 	paymentsRouter.HandleFunc("/update/{id}", Loan_Payments.UpdateLoanPayment).Methods("PUT")
 	paymentsRouter.HandleFunc("/delete/{id}", Loan_Payments.DeleteLoanPayment).Methods("DELETE")
+	paymentsRouter.HandleFunc("/fees/{id}", Loan_Payments.GetLoanFees).Methods("GET")
+	paymentsRouter.HandleFunc("/assess_fees/{id}", Loan_Payments.AssessLoanFees).Methods("POST")
+	paymentsRouter.HandleFunc("/{id}/reverse", Loan_Payments.ReverseLoanPayment).Methods("POST")
+	paymentsRouter.HandleFunc("/refund/{id}", Loan_Payments.RefundCreditBalance).Methods("POST")
+	paymentsRouter.HandleFunc("/schedule/{id}", Loan_Payments.GetRemainingSchedule).Methods("GET")
+	paymentsRouter.HandleFunc("/write_off/{id}", Loan_Payments.GetLoanWriteOff).Methods("GET")
+	paymentsRouter.HandleFunc("/write_off/{id}", Loan_Payments.WriteOffLoan).Methods("POST")
+
+	// Define API endpoints for Loan Restructures
+	restructuresRouter := router.PathPrefix("/loan_restructures").Subrouter()
+	restructuresRouter.HandleFunc("/create", Loan_Restructures.CreateLoanRestructure).Methods("POST")
+	restructuresRouter.HandleFunc("/reset_rates", Loan_Restructures.ResetInterestRates).Methods("POST")
+	restructuresRouter.HandleFunc("/schedules/{id}", Loan_Restructures.GetScheduleVersions).Methods("GET")
+	restructuresRouter.HandleFunc("/{id}", Loan_Restructures.GetLoanRestructures).Methods("GET")
+
+	// Define API endpoints for Reference Rates
+	ratesRouter := router.PathPrefix("/reference_rates").Subrouter()
+	ratesRouter.HandleFunc("/all", Reference_Rates.GetReferenceRates).Methods("GET")
+	ratesRouter.HandleFunc("/create", Reference_Rates.CreateReferenceRates).Methods("POST")
+
+	// Define API endpoints for Reports
+	reportsRouter := router.PathPrefix("/reports").Subrouter()
+	reportsRouter.HandleFunc("/delinquency", Loan_Delinquency.GetDelinquencyReport).Methods("GET")
+	reportsRouter.HandleFunc("/delinquency/run", Loan_Delinquency.RunDelinquency).Methods("POST")
+	reportsRouter.HandleFunc("/delinquency/{id}", Loan_Delinquency.GetLoanDelinquency).Methods("GET")
+
+	// Define API endpoints for Collections
+	collectionsRouter := router.PathPrefix("/collections").Subrouter()
+	collectionsRouter.HandleFunc("/cases", Loan_Collections.GetCollectionCases).Methods("GET")
+	collectionsRouter.HandleFunc("/cases/{id}", Loan_Collections.GetCollectionCaseByID).Methods("GET")
+	collectionsRouter.HandleFunc("/cases/{id}/assign", Loan_Collections.AssignCollectionCase).Methods("PUT")
+	collectionsRouter.HandleFunc("/cases/{id}/contacts", Loan_Collections.CreateContactAttempt).Methods("POST")
+	collectionsRouter.HandleFunc("/cases/{id}/promises", Loan_Collections.CreatePromiseToPay).Methods("POST")
+	collectionsRouter.HandleFunc("/review", Loan_Collections.ReviewCollectionCases).Methods("POST")
+
+	// Define API endpoints for Collateral
+	collateralRouter := router.PathPrefix("/collateral").Subrouter()
+	collateralRouter.HandleFunc("/all", Loan_Collateral.GetCollateral).Methods("GET")
+	collateralRouter.HandleFunc("/ltv/{id}", Loan_Collateral.GetLoanToValue).Methods("GET")
+	collateralRouter.HandleFunc("/{id}", Loan_Collateral.GetCollateralByID).Methods("GET")
+	collateralRouter.HandleFunc("/create", Loan_Collateral.CreateCollateral).Methods("POST")
+	collateralRouter.HandleFunc("/revalue/{id}", Loan_Collateral.RevalueCollateral).Methods("POST")
+	collateralRouter.HandleFunc("/link/{id}", Loan_Collateral.LinkCollateral).Methods("POST")
+	collateralRouter.HandleFunc("/release/{id}", Loan_Collateral.ReleaseCollateral).Methods("POST")
+
+	// Define API endpoints for Applicant Duplicates
+	duplicatesRouter := router.PathPrefix("/applicant_duplicates").Subrouter()
+	duplicatesRouter.HandleFunc("/candidates", Applicant_Duplicates.GetDuplicateCandidates).Methods("GET")
+	duplicatesRouter.HandleFunc("/detect", Applicant_Duplicates.RunDuplicateDetection).Methods("POST")
+	duplicatesRouter.HandleFunc("/candidates/{id}/merge", Applicant_Duplicates.MergeDuplicateCandidate).Methods("POST")
+	duplicatesRouter.HandleFunc("/candidates/{id}/dismiss", Applicant_Duplicates.DismissDuplicateCandidate).Methods("POST")
+	duplicatesRouter.HandleFunc("/merges", Applicant_Duplicates.GetApplicantMerges).Methods("GET")
+
+	// Define API endpoints for Applicant Erasure
+	erasureRouter := router.PathPrefix("/applicant_erasure").Subrouter()
+	erasureRouter.HandleFunc("/requests", Applicant_Erasure.GetErasureRequests).Methods("GET")
+	erasureRouter.HandleFunc("/requests", Applicant_Erasure.CreateErasureRequest).Methods("POST")
+	erasureRouter.HandleFunc("/retention/{id}", Applicant_Erasure.GetRetentionDecision).Methods("GET")
+
+	// Define API endpoints for Borrower Summaries
+	borrowersRouter := router.PathPrefix("/borrowers").Subrouter()
+	borrowersRouter.HandleFunc("/export", Borrower_Summaries.ExportBorrowers).Methods("GET")
+	borrowersRouter.HandleFunc("/{id}/summary", Borrower_Summaries.GetBorrowerSummary).Methods("GET")
+
+	// Define API endpoints for Calendars
+	calendarsRouter := router.PathPrefix("/calendars").Subrouter()
+	calendarsRouter.HandleFunc("/{name}", Calendars.GetCalendar).Methods("GET")
+	calendarsRouter.HandleFunc("/{name}", Calendars.UpdateCalendar).Methods("PUT")
+
+	// Define API endpoints for General Ledger
+	ledgerRouter := router.PathPrefix("/general_ledger").Subrouter()
+	ledgerRouter.HandleFunc("/accounts", General_Ledger.GetAccounts).Methods("GET")
+	ledgerRouter.HandleFunc("/journals/{id}", General_Ledger.GetLoanJournals).Methods("GET")
+	ledgerRouter.HandleFunc("/trial_balance", General_Ledger.GetTrialBalance).Methods("GET")
 }